@@ -0,0 +1,132 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Compression is the compression applied to metrics written with WriteCompressedJSONMetrics.
+type Compression int
+
+const (
+	// CompressionNone writes uncompressed JSON.
+	CompressionNone Compression = iota
+	// CompressionGzip writes gzip compressed JSON (Content-Encoding: gzip).
+	CompressionGzip
+)
+
+var (
+	gzipWriterPool = sync.Pool{
+		New: func() interface{} {
+			return gzip.NewWriter(io.Discard)
+		},
+	}
+	jsonBufferPool = sync.Pool{
+		New: func() interface{} {
+			return new(bytes.Buffer)
+		},
+	}
+)
+
+// WriteCompressedJSONMetrics writes current metrics to w in JSON format, compressed
+// with c, or an error - to be used when handling submission of metrics externally.
+// The result has the uncompressed (BytesSent) and compressed (BytesSentGzip) sizes
+// and the time taken to encode (EncodeDuration). Encoding buffers and compressors
+// are pooled and reused across calls.
+func (tm *TrapMetrics) WriteCompressedJSONMetrics(w io.Writer, c Compression) (*Result, error) {
+	start := time.Now()
+
+	if c != CompressionNone && c != CompressionGzip {
+		return nil, fmt.Errorf("unknown compression (%d)", c)
+	}
+
+	buf := jsonBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer jsonBufferPool.Put(buf)
+
+	// always httptrap JSON, regardless of Config.Encoder
+	if err := tm.encodeMetricsWith(buf, JSONEncoder{}, tm.snapshotMetrics()); err != nil {
+		return nil, fmt.Errorf("writing metrics: %w", err)
+	}
+	if buf.Len() <= 1 {
+		return nil, fmt.Errorf("no valid metrics found")
+	}
+
+	result := &Result{BytesSent: buf.Len()}
+
+	switch c {
+	case CompressionNone:
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return nil, fmt.Errorf("write metrics: %w", err)
+		}
+	case CompressionGzip:
+		n, err := writeGzip(w, buf.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		result.BytesSentGzip = n
+	}
+
+	result.EncodeDuration = time.Since(start)
+
+	return result, nil
+}
+
+// writeGzip writes data gzip compressed to w using a pooled writer, returns
+// the number of compressed bytes written.
+func writeGzip(w io.Writer, data []byte) (int, error) {
+	cw := &countingWriter{w: w}
+
+	zw := gzipWriterPool.Get().(*gzip.Writer)
+	zw.Reset(cw)
+	defer func() {
+		zw.Reset(io.Discard) // do not hold a reference to w while pooled
+		gzipWriterPool.Put(zw)
+	}()
+
+	if _, err := zw.Write(data); err != nil {
+		return cw.n, fmt.Errorf("gzip write: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return cw.n, fmt.Errorf("gzip close: %w", err)
+	}
+
+	return cw.n, nil
+}
+
+// readGzip returns the decompressed contents of gzip compressed data.
+func readGzip(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("gzip reader: %w", err)
+	}
+	defer zr.Close()
+
+	out, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("gzip read: %w", err)
+	}
+
+	return out, nil
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += n
+	return n, err //nolint:wrapcheck // pass through errors of the underlying writer
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestTrapMetrics_WriteCompressedJSONMetrics(t *testing.T) {
+	tests := []struct {
+		encoder     Encoder
+		name        string
+		compression Compression
+		wantErr     bool
+	}{
+		{name: "none", compression: CompressionNone},
+		{name: "gzip", compression: CompressionGzip},
+		{name: "configured encoder ignored", compression: CompressionNone, encoder: statEncoder{}},
+		{name: "unknown", compression: Compression(99), wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			tm, err := New(&Config{Trap: FakeTrap{}, Encoder: tt.encoder})
+			if err != nil {
+				t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+			}
+			for i := 0; i < 100; i++ {
+				if err := tm.CounterIncrement(fmt.Sprintf("counter_%d", i), Tags{{Category: "foo", Value: "bar"}}); err != nil {
+					t.Fatalf("CounterIncrement() error = %v", err)
+				}
+			}
+
+			var buf bytes.Buffer
+			result, err := tm.WriteCompressedJSONMetrics(&buf, tt.compression)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("WriteCompressedJSONMetrics() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				// metrics were not consumed
+				if _, err := tm.JSONMetrics(); err != nil {
+					t.Errorf("JSONMetrics() error = %v, want metrics retained", err)
+				}
+				return
+			}
+
+			data := buf.Bytes()
+			if tt.compression == CompressionGzip {
+				if result.BytesSentGzip != buf.Len() {
+					t.Errorf("BytesSentGzip = %d, want %d", result.BytesSentGzip, buf.Len())
+				}
+				if result.BytesSentGzip >= result.BytesSent {
+					t.Errorf("BytesSentGzip = %d, want < BytesSent %d", result.BytesSentGzip, result.BytesSent)
+				}
+				if data, err = readGzip(data); err != nil {
+					t.Fatalf("readGzip() error = %v", err)
+				}
+			}
+			if result.BytesSent != len(data) {
+				t.Errorf("BytesSent = %d, want %d", result.BytesSent, len(data))
+			}
+
+			metrics, err := DecodeJSONMetrics(data)
+			if err != nil {
+				t.Fatalf("DecodeJSONMetrics() error = %v", err)
+			}
+			if len(metrics) != 100 {
+				t.Errorf("metrics = %d, want 100", len(metrics))
+			}
+
+			// metrics were consumed
+			if _, err := tm.WriteCompressedJSONMetrics(&buf, tt.compression); err == nil {
+				t.Error("WriteCompressedJSONMetrics() expected error, no metrics")
+			}
+		})
+	}
+}
+
+func BenchmarkWriteCompressedJSONMetrics(b *testing.B) {
+	tm, _ := New(&Config{Trap: FakeTrap{}})
+	var buf bytes.Buffer
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for j := 0; j < 1000; j++ {
+			_ = tm.CounterIncrement(fmt.Sprintf("counter_%d", j), nil)
+		}
+		buf.Reset()
+		b.StartTimer()
+		_, _ = tm.WriteCompressedJSONMetrics(&buf, CompressionGzip)
+	}
+}
@@ -20,42 +20,58 @@ func (tm *TrapMetrics) CounterIncrement(name string, tags Tags) error {
 
 // CounterIncrementByValue will increment the named counter by the passed value.
 func (tm *TrapMetrics) CounterIncrementByValue(name string, tags Tags, val uint64) error {
-	mt := mtCounter
+	metricID, err := generateMetricID(name, mtCounter, tags)
+	if err != nil {
+		return err
+	}
 
-	metricID, err := generateMetricID(name, mt, tags)
+	return tm.counterAdd(metricID, name, tags, int64(val))
+}
+
+// CounterAdjustByValue will adjust the named counter by the passed value.
+func (tm *TrapMetrics) CounterAdjustByValue(name string, tags Tags, val int64) error {
+	metricID, err := generateMetricID(name, mtCounter, tags)
 	if err != nil {
 		return err
 	}
 
-	tm.metricsmu.Lock()
-	defer tm.metricsmu.Unlock()
+	return tm.counterAdd(metricID, name, tags, val)
+}
+
+// counterAdd will adjust the counter identified by metricID by the passed value.
+func (tm *TrapMetrics) counterAdd(metricID uint64, name string, tags Tags, val int64) error {
+	mt := mtCounter
+
+	sh := tm.metrics.shard(metricID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	if m, ok := tm.metrics[metricID]; ok {
+	if m, ok := sh.metrics[metricID]; ok {
 		if m.Mtype != mtCounter {
 			return fmt.Errorf("(%s %s) exists with different type (counter) vs (%s)", name, tags.String(), m.Mtype)
 		}
 		v, ok := m.Samples[0].(int64)
 		if ok {
-			v += int64(val)
+			v += val
 			m.Samples[0] = v
 		}
 		return nil
 	}
 
-	m, err := tm.newMetric(name, mt, tags)
+	m, err := tm.newMetricWithID(metricID, name, mt, tags)
 	if err != nil {
 		return fmt.Errorf("(%s %s) failed to initialize (counter): %w", name, tags.String(), err)
 	}
 	m.Rtype = rtInt64
-	m.Samples[0] = int64(val)
+	m.Samples[0] = val
 
-	tm.metrics[metricID] = m
+	sh.metrics[metricID] = m
 
 	return nil
 }
 
-// CounterAdjustByValue will adjust the named counter by the passed value.
-func (tm *TrapMetrics) CounterAdjustByValue(name string, tags Tags, val int64) error {
+// counterSet will set the named counter to the passed value.
+func (tm *TrapMetrics) counterSet(name string, tags Tags, val int64) error {
 	mt := mtCounter
 
 	metricID, err := generateMetricID(name, mt, tags)
@@ -63,18 +79,15 @@ func (tm *TrapMetrics) CounterAdjustByValue(name string, tags Tags, val int64) e
 		return err
 	}
 
-	tm.metricsmu.Lock()
-	defer tm.metricsmu.Unlock()
+	sh := tm.metrics.shard(metricID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	if m, ok := tm.metrics[metricID]; ok {
+	if m, ok := sh.metrics[metricID]; ok {
 		if m.Mtype != mtCounter {
 			return fmt.Errorf("(%s %s) exists with different type (counter) vs (%s)", name, tags.String(), m.Mtype)
 		}
-		v, ok := m.Samples[0].(int64)
-		if ok {
-			v += val
-			m.Samples[0] = v
-		}
+		m.Samples[0] = val
 		return nil
 	}
 
@@ -85,7 +98,7 @@ func (tm *TrapMetrics) CounterAdjustByValue(name string, tags Tags, val int64) e
 	m.Rtype = rtInt64
 	m.Samples[0] = val
 
-	tm.metrics[metricID] = m
+	sh.metrics[metricID] = m
 
 	return nil
 }
@@ -97,10 +110,13 @@ func (tm *TrapMetrics) CounterFetch(name string, tags Tags) (*Metric, error) {
 		return nil, err
 	}
 
-	tm.metricsmu.Lock()
-	defer tm.metricsmu.Unlock()
+	tm.foldHandles()
+
+	sh := tm.metrics.shard(metricID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	if m, ok := tm.metrics[metricID]; ok {
+	if m, ok := sh.metrics[metricID]; ok {
 		return m, nil
 	}
 
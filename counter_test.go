@@ -67,3 +67,49 @@ func TestTrapMetrics_CounterIncrement(t *testing.T) {
 		})
 	}
 }
+
+func TestTrapMetrics_CounterPersistent(t *testing.T) {
+	tests := []struct {
+		name       string
+		wantJSON   []string
+		persistent bool
+	}{
+		{
+			name:       "reset on flush",
+			persistent: false,
+			wantJSON:   []string{`"_value":"2"`, `"_value":"1"`},
+		},
+		{
+			name:       "persistent",
+			persistent: true,
+			wantJSON:   []string{`"_value":"2"`, `"_value":"3"`},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			tm, err := New(&Config{Trap: FakeTrap{}, PersistentCounters: tt.persistent})
+			if err != nil {
+				t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+			}
+
+			if err := tm.CounterIncrementByValue("test", nil, 2); err != nil {
+				t.Fatalf("TrapMetrics.CounterIncrementByValue() error = %v", err)
+			}
+
+			for i, want := range tt.wantJSON {
+				if i > 0 {
+					if err := tm.CounterIncrement("test", nil); err != nil {
+						t.Fatalf("TrapMetrics.CounterIncrement() error = %v", err)
+					}
+				}
+				if jm, err := tm.JSONMetrics(); err != nil {
+					t.Fatalf("flushing metrics: %s", err)
+				} else if !strings.Contains(string(jm), want) {
+					t.Errorf("flush %d json metrics want [%v] got [%v]", i, want, string(jm))
+				}
+			}
+		})
+	}
+}
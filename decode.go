@@ -0,0 +1,257 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/openhistogram/circonusllhist"
+)
+
+// jsonSample is a single metric sample in httptrap format.
+type jsonSample struct {
+	TS    *uint64         `json:"_ts"`
+	Type  string          `json:"_type"`
+	Value json.RawMessage `json:"_value"`
+}
+
+// DecodeJSONMetrics parses metrics in httptrap JSON format (e.g. the output of
+// JSONMetrics) back into Metrics. Stream tags are decoded into Tags (base64
+// encoded categories and values are decoded), samples are keyed by their _ts.
+//
+// NOTE: the httptrap format does not distinguish counters from gauges, so numeric
+// metrics are decoded as gauges. h and H types are decoded as histograms and
+// cumulative histograms, s as text. Repeated keys (e.g. multiple samples for a
+// gauge) are combined into a single metric.
+func DecodeJSONMetrics(data []byte) (Metrics, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, fmt.Errorf("reading metrics: %w", err)
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '{' {
+		return nil, fmt.Errorf("invalid metrics, expected object")
+	}
+
+	metrics := make(Metrics)
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("reading metric name: %w", err)
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid metric name (%v)", tok)
+		}
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, fmt.Errorf("reading metric (%s): %w", key, err)
+		}
+
+		m, err := decodeJSONMetric(key, raw)
+		if err != nil {
+			return nil, err
+		}
+
+		if cur, ok := metrics[m.ID]; ok {
+			if err := mergeMetric(cur, m); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		metrics[m.ID] = m
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return nil, fmt.Errorf("reading metrics: %w", err)
+	}
+
+	return metrics, nil
+}
+
+func decodeJSONMetric(key string, raw json.RawMessage) (*Metric, error) {
+	name, tags, err := parseStreamTaggedName(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var sample jsonSample
+	if len(raw) > 0 && raw[0] == '{' {
+		if err := json.Unmarshal(raw, &sample); err != nil {
+			return nil, fmt.Errorf("decoding metric (%s): %w", key, err)
+		}
+	} else {
+		// httptrap also accepts bare values, type is inferred
+		sample.Value = raw
+		sample.Type = rtFloat64
+		if len(raw) > 0 && raw[0] == '"' {
+			sample.Type = rtString
+		}
+	}
+
+	var sampleKey uint64
+	if sample.TS != nil {
+		sampleKey = *sample.TS
+	}
+
+	mt := mtGauge
+	switch sample.Type {
+	case rtString:
+		mt = mtText
+	case rtHistogram:
+		mt = mtHistogram
+		sampleKey = 0
+	case rtCumulativeHistogram:
+		mt = mtCumulativeHistogram
+		sampleKey = 0
+	}
+
+	id, err := generateMetricID(name, mt, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	val, err := decodeJSONValue(sample.Type, sample.Value)
+	if err != nil {
+		return nil, fmt.Errorf("decoding metric (%s): %w", key, err)
+	}
+
+	m := &Metric{
+		ID:      id,
+		Name:    name,
+		Tags:    tags,
+		Mtype:   mt,
+		Rtype:   sample.Type,
+		Samples: Samples{sampleKey: val},
+	}
+
+	return m, nil
+}
+
+func decodeJSONValue(rtype string, raw json.RawMessage) (interface{}, error) {
+	// 64bit numbers are sent as strings, others as json numbers
+	s := string(raw)
+	if strings.HasPrefix(s, `"`) {
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, fmt.Errorf("invalid value (%s): %w", raw, err)
+		}
+	}
+
+	var (
+		val interface{}
+		err error
+	)
+
+	switch rtype {
+	case rtInt32:
+		var v int64
+		v, err = strconv.ParseInt(s, 10, 32)
+		val = int32(v)
+	case rtUint32:
+		var v uint64
+		v, err = strconv.ParseUint(s, 10, 32)
+		val = uint32(v)
+	case rtInt64:
+		val, err = strconv.ParseInt(s, 10, 64)
+	case rtUint64:
+		val, err = strconv.ParseUint(s, 10, 64)
+	case rtFloat64:
+		val, err = strconv.ParseFloat(s, 64)
+	case rtString:
+		val = s
+	case rtHistogram, rtCumulativeHistogram:
+		var data []byte
+		data, err = base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			break
+		}
+		val, err = circonusllhist.Deserialize(bytes.NewReader(data))
+	default:
+		return nil, fmt.Errorf("unknown metric type (%s)", rtype)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid value (%s) for type (%s): %w", s, rtype, err)
+	}
+
+	return val, nil
+}
+
+// parseStreamTaggedName splits a stream tagged metric name (name|ST[cat:val,...]) into
+// the name and tags, decoding any base64 encoded (b"...") categories and values.
+func parseStreamTaggedName(key string) (string, Tags, error) {
+	i := strings.Index(key, "|ST[")
+	if i < 0 {
+		return key, nil, nil
+	}
+	if !strings.HasSuffix(key, "]") {
+		return "", nil, fmt.Errorf("invalid stream tags (%s)", key)
+	}
+
+	name := key[:i]
+	list := key[i+len("|ST[") : len(key)-1]
+
+	var tags Tags
+	for _, t := range splitOutsideQuotes(list, ',') {
+		if t == "" {
+			continue
+		}
+		parts := splitOutsideQuotes(t, ':')
+		cat, err := decodeTagPart(parts[0])
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid tag (%s): %w", t, err)
+		}
+		val := ""
+		if len(parts) > 1 {
+			val, err = decodeTagPart(strings.Join(parts[1:], ":"))
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid tag (%s): %w", t, err)
+			}
+		}
+		tags = append(tags, Tag{Category: cat, Value: val})
+	}
+
+	return name, tags, nil
+}
+
+func decodeTagPart(s string) (string, error) {
+	if !strings.HasPrefix(s, `b"`) || !strings.HasSuffix(s, `"`) || len(s) < 3 {
+		return s, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(s[2 : len(s)-1])
+	if err != nil {
+		return "", fmt.Errorf("base64 decode: %w", err)
+	}
+	return string(data), nil
+}
+
+// splitOutsideQuotes splits s on sep, ignoring any sep between double quotes.
+func splitOutsideQuotes(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/openhistogram/circonusllhist"
+)
+
+func TestDecodeJSONMetrics(t *testing.T) {
+	tm, err := New(&Config{Trap: FakeTrap{}, GlobalTags: Tags{{Category: "host", Value: "h1"}}})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+
+	ts := time.Now()
+	ts2 := ts.Add(time.Second)
+	tags := Tags{{Category: "foo", Value: "bar:baz"}, {Category: "empty"}}
+
+	if err := tm.CounterIncrementByValue("counter", tags, 5); err != nil {
+		t.Fatalf("TrapMetrics.CounterIncrementByValue() error = %v", err)
+	}
+	for _, val := range []interface{}{int(-3), uint32(7), uint64(1 << 40), 2.5} {
+		if err := tm.GaugeSet("gauge_"+reflect.TypeOf(val).Name(), tags, val, &ts); err != nil {
+			t.Fatalf("TrapMetrics.GaugeSet() error = %v", err)
+		}
+	}
+	if err := tm.GaugeSet("gauge_multi", nil, 1.5, &ts2); err != nil {
+		t.Fatalf("TrapMetrics.GaugeSet() error = %v", err)
+	}
+	if err := tm.GaugeSet("gauge_multi", nil, 2.5, &ts); err != nil {
+		t.Fatalf("TrapMetrics.GaugeSet() error = %v", err)
+	}
+	if err := tm.TextSet("text", tags, `say "hi"`, &ts); err != nil {
+		t.Fatalf("TrapMetrics.TextSet() error = %v", err)
+	}
+	if err := tm.HistogramRecordCountForValue("histogram", tags, 3, 1.5); err != nil {
+		t.Fatalf("TrapMetrics.HistogramRecordCountForValue() error = %v", err)
+	}
+	if err := tm.CumulativeHistogramRecordCountForValue("cumulative", tags, 2, 10); err != nil {
+		t.Fatalf("TrapMetrics.CumulativeHistogramRecordCountForValue() error = %v", err)
+	}
+
+	data, err := tm.JSONMetrics()
+	if err != nil {
+		t.Fatalf("TrapMetrics.JSONMetrics() error = %v", err)
+	}
+
+	metrics, err := DecodeJSONMetrics(data)
+	if err != nil {
+		t.Fatalf("DecodeJSONMetrics() error = %v", err)
+	}
+
+	wantTags := Tags{{Category: "empty"}, {Category: "foo", Value: "bar:baz"}, {Category: "host", Value: "h1"}}
+	sk := generateSampleKey(&ts)
+
+	tests := []struct {
+		want  interface{}
+		name  string
+		mtype string
+		tags  Tags
+		key   uint64
+	}{
+		{name: "counter", mtype: mtGauge, tags: wantTags, want: int64(5)},
+		{name: "gauge_int", mtype: mtGauge, tags: wantTags, key: sk, want: int32(-3)},
+		{name: "gauge_uint32", mtype: mtGauge, tags: wantTags, key: sk, want: uint32(7)},
+		{name: "gauge_uint64", mtype: mtGauge, tags: wantTags, key: sk, want: uint64(1 << 40)},
+		{name: "gauge_float64", mtype: mtGauge, tags: wantTags, key: sk, want: 2.5},
+		{name: "gauge_multi", mtype: mtGauge, tags: Tags{{Category: "host", Value: "h1"}}, key: sk, want: 2.5},
+		{name: "text", mtype: mtText, tags: wantTags, key: sk, want: `say "hi"`},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			id, _ := generateMetricID(tt.name, tt.mtype, tt.tags)
+			m, ok := metrics[id]
+			if !ok {
+				t.Fatalf("metric not found in %v", metrics)
+			}
+			if tt.name == "counter" {
+				// counter sample keyed by flush time
+				for _, v := range m.Samples {
+					if v != tt.want {
+						t.Errorf("value want %v got %v", tt.want, v)
+					}
+				}
+				return
+			}
+			if v := m.Samples[tt.key]; v != tt.want {
+				t.Errorf("value want [%v]%T got [%v]%T", tt.want, tt.want, v, v)
+			}
+		})
+	}
+
+	for name, mt := range map[string]string{"histogram": mtHistogram, "cumulative": mtCumulativeHistogram} {
+		id, _ := generateMetricID(name, mt, wantTags)
+		m, ok := metrics[id]
+		if !ok {
+			t.Fatalf("%s not found", name)
+		}
+		h, ok := m.Samples[0].(*circonusllhist.Histogram)
+		if !ok {
+			t.Fatalf("%s invalid sample %v", name, m.Samples[0])
+		}
+		if h.Count() == 0 {
+			t.Errorf("%s expected samples", name)
+		}
+	}
+
+	gm, _ := generateMetricID("gauge_multi", mtGauge, Tags{{Category: "host", Value: "h1"}})
+	if len(metrics[gm].Samples) != 2 {
+		t.Errorf("gauge_multi samples want 2 got %d", len(metrics[gm].Samples))
+	}
+
+	// re-encoding the decoded metrics produces the same records
+	var buf bytes.Buffer
+	tm2, _ := New(&Config{})
+	if err := tm2.encodeMetrics(&buf, metrics); err != nil {
+		t.Fatalf("encodeMetrics() error = %v", err)
+	}
+	again, err := DecodeJSONMetrics(buf.Bytes())
+	if err != nil {
+		t.Fatalf("DecodeJSONMetrics() re-encoded error = %v", err)
+	}
+	if len(again) != len(metrics) {
+		t.Errorf("re-encoded metrics want %d got %d", len(metrics), len(again))
+	}
+}
+
+func TestDecodeJSONMetrics_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "not object", data: `[]`},
+		{name: "bad type", data: `{"a":{"_type":"x","_value":1}}`},
+		{name: "bad value", data: `{"a":{"_type":"L","_value":"abc"}}`},
+		{name: "bad tags", data: `{"a|ST[b\"!!\":x]":{"_type":"n","_value":"1"}}`},
+		{name: "truncated", data: `{"a":{"_type":"n","_value":"1"}`},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeJSONMetrics([]byte(tt.data)); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+
+	// bare values are accepted
+	metrics, err := DecodeJSONMetrics([]byte(`{"a":1.5,"b":"text"}`))
+	if err != nil {
+		t.Fatalf("DecodeJSONMetrics() error = %v", err)
+	}
+	var vals []interface{}
+	for _, m := range metrics {
+		vals = append(vals, m.Samples[0])
+	}
+	if len(vals) != 2 {
+		t.Errorf("bare values want 2 got %v", vals)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/openhistogram/circonusllhist"
+)
+
+// Encoder encodes metric samples into a submission payload. Samples are
+// appended to dst, a payload is the header, one or more samples, then the footer.
+//
+// Flush, JSONMetrics and WriteJSONMetrics use the encoder from Config.Encoder,
+// WriteMetrics writes metrics with any encoder (e.g. to emit the container in
+// the format of another backend alongside submissions to Circonus).
+type Encoder interface {
+	// AppendHeader appends anything preceding the first sample of a payload.
+	AppendHeader(dst []byte) []byte
+	// AppendSample appends a single sample, first is true for the first sample of a payload.
+	AppendSample(dst []byte, s *Sample, first bool) ([]byte, error)
+	// AppendFooter appends anything following the last sample of a payload.
+	AppendFooter(dst []byte) []byte
+}
+
+// Sample is a single metric sample passed to an Encoder.
+type Sample struct {
+	// Value of the sample - numeric types for counters and gauges, string for
+	// text and *circonusllhist.Histogram for histograms
+	Value interface{}
+	// Name of the metric
+	Name string
+	// MetricType of the metric (counter, gauge, histogram, cumulative_histogram or text)
+	MetricType string
+	// Type reconnoiter type of the value (i, I, l, L, n, s, h, H)
+	Type string
+	// Tags of the metric, including global tags
+	Tags Tags
+	// Timestamp in milliseconds, 0 when not set for gauge and text samples
+	Timestamp uint64
+	// Flush is true when Timestamp is the flush time (counters and histograms)
+	Flush bool
+}
+
+// WriteMetrics writes current metrics to w encoded with enc (as a single payload)
+// or an error - to be used when handling submission of metrics externally in a
+// format other than Config.Encoder. Metrics are consumed as with WriteJSONMetrics.
+func (tm *TrapMetrics) WriteMetrics(w io.Writer, enc Encoder) error {
+	if enc == nil {
+		return fmt.Errorf("invalid encoder (nil)")
+	}
+	return tm.encodeMetricsWith(w, enc, tm.snapshotMetrics())
+}
+
+// JSONEncoder encodes samples in httptrap JSON format, the default encoder:
+//
+//	{"name|ST[tags]":{"_type":"l","_ts":1631202930123,"_value":"1"},...}
+type JSONEncoder struct{}
+
+var histogramBufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// AppendHeader starts the JSON object.
+func (JSONEncoder) AppendHeader(dst []byte) []byte {
+	return append(dst, '{')
+}
+
+// AppendSample appends a sample as a JSON object member.
+func (JSONEncoder) AppendSample(dst []byte, s *Sample, first bool) ([]byte, error) {
+	name, err := streamTaggedName(s)
+	if err != nil {
+		return dst, err
+	}
+
+	val := s.Value
+	if h, ok := val.(*circonusllhist.Histogram); ok {
+		hb := histogramBufferPool.Get().(*bytes.Buffer)
+		defer histogramBufferPool.Put(hb)
+		if err := serializeHistogram(hb, h); err != nil {
+			return dst, err
+		}
+		val = hb.Bytes()
+	}
+
+	return appendMetric(dst, &first, name, s.Type, val, s.Timestamp), nil
+}
+
+// AppendFooter ends the JSON object.
+func (JSONEncoder) AppendFooter(dst []byte) []byte {
+	return append(dst, '}')
+}
+
+// streamTaggedName returns the metric name with stream tags, or an error if
+// it exceeds the maximum the broker accepts.
+func streamTaggedName(s *Sample) (string, error) {
+	name := s.Name + s.Tags.Stream()
+	if len(name) > maxMetricNameLen {
+		return "", fmt.Errorf("metric name exceeds max len (%s)", name)
+	}
+	return name, nil
+}
+
+// serializeHistogram writes the base64 serialized histogram to hb.
+func serializeHistogram(hb *bytes.Buffer, h *circonusllhist.Histogram) error {
+	hb.Reset()
+	if err := h.SerializeB64(hb); err != nil {
+		return fmt.Errorf("serializing histogram: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openhistogram/circonusllhist"
+)
+
+// lineEncoder writes one "name type value" line per sample.
+type lineEncoder struct{}
+
+func (lineEncoder) AppendHeader(dst []byte) []byte { return dst }
+func (lineEncoder) AppendFooter(dst []byte) []byte { return dst }
+func (lineEncoder) AppendSample(dst []byte, s *Sample, _ bool) ([]byte, error) {
+	return append(dst, fmt.Sprintf("%s%s %s %v\n", s.Name, s.Tags.Stream(), s.Type, s.Value)...), nil
+}
+
+func TestJSONEncoder(t *testing.T) {
+	ts := time.UnixMilli(1631202930123)
+	h := circonusllhist.New()
+	_ = h.RecordValue(1.5)
+
+	tests := []struct {
+		name   string
+		sample Sample
+		want   string
+		first  bool
+	}{
+		{
+			name:   "counter",
+			sample: Sample{Name: "foo", Type: rtInt64, Value: int64(5), Timestamp: 1631202930123, Flush: true},
+			first:  true,
+			want:   `"foo":{"_type":"l","_ts":1631202930123,"_value":"5"}`,
+		},
+		{
+			name:   "gauge without timestamp",
+			sample: Sample{Name: "foo", Type: rtFloat64, Value: 2.4},
+			want:   `,"foo":{"_type":"n","_ts":0,"_value":"2.400000"}`,
+		},
+		{
+			name:   "gauge with timestamp",
+			sample: Sample{Name: "foo", Type: rtFloat64, Value: float32(0.1), Timestamp: generateSampleKey(&ts)},
+			want:   `,"foo":{"_type":"n","_ts":1631202930123,"_value":"0.100000"}`,
+		},
+		{
+			name:   "text with tags",
+			sample: Sample{Name: "foo", Type: rtString, Value: `a "b"`, Tags: Tags{{Category: "c", Value: "d"}}},
+			want:   `,"foo|ST[b\"Yw==\":b\"ZA==\"]":{"_type":"s","_ts":0,"_value":"a \"b\""}`,
+		},
+		{
+			name:   "int32",
+			sample: Sample{Name: "foo", Type: rtInt32, Value: int32(-3), Flush: true, Timestamp: 1},
+			want:   `,"foo":{"_type":"i","_ts":1,"_value":-3}`,
+		},
+		{
+			name:   "histogram",
+			sample: Sample{Name: "foo", Type: rtHistogram, Value: h, Flush: true, Timestamp: 1},
+			want:   `,"foo":{"_type":"h","_ts":1,"_value":"AAEPAAAB"}`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := JSONEncoder{}.AppendSample(nil, &tt.sample, tt.first)
+			if err != nil {
+				t.Fatalf("AppendSample() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("AppendSample() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrapMetrics_Encoder(t *testing.T) {
+	tests := []struct {
+		encoder Encoder
+		name    string
+		want    []string
+		max     int
+	}{
+		{
+			name:    "default",
+			encoder: nil,
+			want:    []string{`"_ts":`, `"_value":"2"`},
+		},
+		{
+			name:    "default chunked",
+			encoder: JSONEncoder{},
+			max:     1,
+			want:    []string{`{"a":{"_type":"l","_ts":`, `{"b":{"_type":"n","_ts":0,"_value":"0.500000"}}`},
+		},
+		{
+			name:    "custom",
+			encoder: lineEncoder{},
+			want:    []string{"a l 2\n", "b n 0.5\n"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			trap := &RecordingTrap{}
+			tm, err := New(&Config{Trap: trap, Encoder: tt.encoder, MaxPayloadMetrics: tt.max})
+			if err != nil {
+				t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+			}
+
+			_ = tm.CounterIncrementByValue("a", nil, 2)
+			_ = tm.GaugeSet("b", nil, 0.5, nil)
+
+			if _, err := tm.Flush(context.Background()); err != nil {
+				t.Fatalf("Flush() error = %v", err)
+			}
+
+			payloads := trap.Payloads()
+			if tt.max > 0 && len(payloads) != 2 {
+				t.Fatalf("payloads = %d, want 2", len(payloads))
+			}
+			all := string(bytes.Join(payloads, nil))
+			for _, want := range tt.want {
+				if !strings.Contains(all, want) {
+					t.Errorf("payload = %s, want %s", all, want)
+				}
+			}
+			if _, ok := tt.encoder.(lineEncoder); !ok {
+				for _, p := range payloads {
+					if _, err := DecodeJSONMetrics(p); err != nil {
+						t.Errorf("DecodeJSONMetrics(%s) error = %v", p, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// kindEncoder writes one "kind name value" line per sample.
+type kindEncoder struct{}
+
+func (kindEncoder) AppendHeader(dst []byte) []byte { return append(dst, "# metrics\n"...) }
+func (kindEncoder) AppendFooter(dst []byte) []byte { return append(dst, "# end\n"...) }
+func (kindEncoder) AppendSample(dst []byte, s *Sample, _ bool) ([]byte, error) {
+	return append(dst, fmt.Sprintf("%s %s %s %d %v\n", s.MetricType, s.Name, s.Tags.String(), s.Timestamp, s.Flush)...), nil
+}
+
+func TestTrapMetrics_WriteMetrics(t *testing.T) {
+	tm, err := New(&Config{Trap: FakeTrap{}, GlobalTags: Tags{{Category: "env", Value: "test"}}})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+
+	ts := time.UnixMilli(1631202930123)
+	_ = tm.CounterIncrement("c", nil)
+	_ = tm.GaugeSet("g", Tags{{Category: "a", Value: "b"}}, 1, &ts)
+	_ = tm.TextSet("t", nil, "x", nil)
+	_ = tm.HistogramRecordValue("h", nil, 1)
+
+	if err := tm.WriteMetrics(&bytes.Buffer{}, nil); err == nil {
+		t.Error("WriteMetrics() expected error for nil encoder")
+	}
+
+	var buf bytes.Buffer
+	if err := tm.WriteMetrics(&buf, kindEncoder{}); err != nil {
+		t.Fatalf("WriteMetrics() error = %v", err)
+	}
+
+	got := buf.String()
+	if !strings.HasPrefix(got, "# metrics\n") || !strings.HasSuffix(got, "# end\n") {
+		t.Errorf("WriteMetrics() = %q, want header and footer", got)
+	}
+	for _, want := range []string{
+		"counter c env:test ",
+		"gauge g a:b,env:test 1631202930123 false\n",
+		"text t env:test 0 false\n",
+		"histogram h env:test ",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("WriteMetrics() = %s, want %s", got, want)
+		}
+	}
+
+	// metrics are consumed
+	buf.Reset()
+	if err := tm.WriteMetrics(&buf, kindEncoder{}); err != nil {
+		t.Fatalf("WriteMetrics() error = %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("WriteMetrics() = %q, want no metrics", buf.String())
+	}
+}
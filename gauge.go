@@ -12,13 +12,18 @@ import (
 
 // GaugeSet sets a sample with a given timestamp for a gauge to the passed value.
 func (tm *TrapMetrics) GaugeSet(name string, tags Tags, val interface{}, ts *time.Time) error {
-	mt := mtGauge
-
-	metricID, err := generateMetricID(name, mt, tags)
+	metricID, err := generateMetricID(name, mtGauge, tags)
 	if err != nil {
 		return err
 	}
 
+	return tm.gaugeSet(metricID, name, tags, val, ts)
+}
+
+// gaugeSet sets a sample for the gauge identified by metricID.
+func (tm *TrapMetrics) gaugeSet(metricID uint64, name string, tags Tags, val interface{}, ts *time.Time) error {
+	mt := mtGauge
+
 	sampleKey := generateSampleKey(ts)
 	rtype := ""
 
@@ -28,10 +33,11 @@ func (tm *TrapMetrics) GaugeSet(name string, tags Tags, val interface{}, ts *tim
 	}
 	rtype = rt
 
-	tm.metricsmu.Lock()
-	defer tm.metricsmu.Unlock()
+	sh := tm.metrics.shard(metricID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	if m, ok := tm.metrics[metricID]; ok {
+	if m, ok := sh.metrics[metricID]; ok {
 		if m.Mtype != mtGauge {
 			return fmt.Errorf("(%s %s) exists with different type (gauge) vs (%s)", name, tags.String(), m.Mtype)
 		}
@@ -39,26 +45,32 @@ func (tm *TrapMetrics) GaugeSet(name string, tags Tags, val interface{}, ts *tim
 		return nil
 	}
 
-	m, err := tm.newMetric(name, mt, tags)
+	m, err := tm.newMetricWithID(metricID, name, mt, tags)
 	if err != nil {
 		return fmt.Errorf("(%s %s) failed to initialize (gauge): %w", name, tags.String(), err)
 	}
 	m.Rtype = rtype
 	m.Samples[sampleKey] = val
 
-	tm.metrics[metricID] = m
+	sh.metrics[metricID] = m
 
 	return nil
 }
 
 // GaugeAdd adds a sample with a given timestamp for a gauge to the passed value.
 func (tm *TrapMetrics) GaugeAdd(name string, tags Tags, val interface{}, ts *time.Time) error {
-	mt := mtGauge
-
-	metricID, err := generateMetricID(name, mt, tags)
+	metricID, err := generateMetricID(name, mtGauge, tags)
 	if err != nil {
 		return err
 	}
+
+	return tm.gaugeAdd(metricID, name, tags, val, ts)
+}
+
+// gaugeAdd adds a sample for the gauge identified by metricID.
+func (tm *TrapMetrics) gaugeAdd(metricID uint64, name string, tags Tags, val interface{}, ts *time.Time) error {
+	mt := mtGauge
+
 	sampleKey := generateSampleKey(ts)
 	rtype := ""
 
@@ -68,10 +80,11 @@ func (tm *TrapMetrics) GaugeAdd(name string, tags Tags, val interface{}, ts *tim
 	}
 	rtype = rt
 
-	tm.metricsmu.Lock()
-	defer tm.metricsmu.Unlock()
+	sh := tm.metrics.shard(metricID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	if m, ok := tm.metrics[metricID]; ok {
+	if m, ok := sh.metrics[metricID]; ok {
 		if m.Mtype != mtGauge {
 			return fmt.Errorf("(%s %s) exists with different type (gauge) vs (%s)", name, tags.String(), m.Mtype)
 		}
@@ -86,14 +99,14 @@ func (tm *TrapMetrics) GaugeAdd(name string, tags Tags, val interface{}, ts *tim
 		return nil
 	}
 
-	m, err := tm.newMetric(name, mt, tags)
+	m, err := tm.newMetricWithID(metricID, name, mt, tags)
 	if err != nil {
 		return fmt.Errorf("(%s %s) failed to initialize (gauge): %w", name, tags.String(), err)
 	}
 	m.Rtype = rtype
 	m.Samples[sampleKey] = val
 
-	tm.metrics[metricID] = m
+	sh.metrics[metricID] = m
 
 	return nil
 }
@@ -173,10 +186,13 @@ func (tm *TrapMetrics) GaugeFetch(name string, tags Tags) (*Metric, error) {
 		return nil, err
 	}
 
-	tm.metricsmu.Lock()
-	defer tm.metricsmu.Unlock()
+	tm.foldHandles()
+
+	sh := tm.metrics.shard(metricID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	if m, ok := tm.metrics[metricID]; ok {
+	if m, ok := sh.metrics[metricID]; ok {
 		return m, nil
 	}
 
@@ -0,0 +1,216 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/openhistogram/circonusllhist"
+)
+
+var (
+	defaultGraphiteQuantiles = []float64{0.5, 0.9, 0.99}
+
+	graphitePathReplacer     = strings.NewReplacer(" ", "_", ";", "_", "\t", "_", "\n", "_")
+	graphiteTagNameReplacer  = strings.NewReplacer(" ", "_", ";", "_", "!", "_", "^", "_", "=", "_", "~", "_", "\t", "_", "\n", "_")
+	graphiteTagValueReplacer = strings.NewReplacer(" ", "_", ";", "_", "~", "_", "\t", "_", "\n", "_")
+)
+
+// GraphiteEncoder encodes samples in the Graphite plaintext protocol, one line per sample:
+//
+//	name;tag=value 1.5 1631202930   (Tags, Graphite 1.1+ tagged series)
+//	name.tag.value 1.5 1631202930   (dotted path, tag categories and values appended to the name)
+//
+// Counters and gauges are written as-is, histograms are flattened into a count
+// and a series for each quantile (e.g. name.p99), text metrics are skipped.
+// Timestamps are in seconds, samples without a timestamp are stamped with the
+// current time. Characters which are not valid in a path, tag name or tag value
+// are replaced with '_' (and '.' in dotted path tag values).
+//
+// Use with WriteMetrics, or SendGraphite to send to a Carbon listener.
+type GraphiteEncoder struct {
+	// Prefix prepended to every metric name (e.g. "app.")
+	Prefix string
+	// Quantiles to include for histograms (default: 0.5, 0.9, 0.99)
+	Quantiles []float64
+	// Tags write Graphite tagged series (name;tag=value), otherwise tags are
+	// appended to the name as a dotted path
+	Tags bool
+}
+
+// AppendHeader is a no-op, the plaintext protocol has no header.
+func (GraphiteEncoder) AppendHeader(dst []byte) []byte {
+	return dst
+}
+
+// AppendSample appends a sample as one or more lines.
+func (e GraphiteEncoder) AppendSample(dst []byte, s *Sample, _ bool) ([]byte, error) {
+	if s.Name == "" {
+		return dst, fmt.Errorf("invalid metric name (empty)")
+	}
+
+	ts := int64(s.Timestamp / 1000)
+	if s.Timestamp == 0 {
+		ts = time.Now().Unix()
+	}
+
+	switch v := s.Value.(type) {
+	case string:
+		return dst, nil
+	case *circonusllhist.Histogram:
+		quantiles := e.Quantiles
+		if len(quantiles) == 0 {
+			quantiles = defaultGraphiteQuantiles
+		}
+		stats, err := summarizeHistogram(v, quantiles)
+		if err != nil {
+			return dst, fmt.Errorf("(%s %s): %w", s.Name, s.Tags.String(), err)
+		}
+		dst = e.appendLine(dst, s, "count", strconv.AppendUint(nil, stats.Count, 10), ts)
+		if stats.Count == 0 {
+			return dst, nil
+		}
+		for i, q := range quantiles {
+			if val, ok := appendGraphiteFloat(nil, stats.Quantiles[i]); ok {
+				dst = e.appendLine(dst, s, quantileName(q), val, ts)
+			}
+		}
+		return dst, nil
+	case float32:
+		val, ok := appendGraphiteFloat(nil, float64(v))
+		if !ok {
+			return dst, fmt.Errorf("(%s %s): unsupported float value (%v)", s.Name, s.Tags.String(), v)
+		}
+		return e.appendLine(dst, s, "", val, ts), nil
+	case float64:
+		val, ok := appendGraphiteFloat(nil, v)
+		if !ok {
+			return dst, fmt.Errorf("(%s %s): unsupported float value (%v)", s.Name, s.Tags.String(), v)
+		}
+		return e.appendLine(dst, s, "", val, ts), nil
+	}
+
+	val, ok := appendInteger(nil, s.Value)
+	if !ok {
+		return dst, fmt.Errorf("(%s %s): unsupported value type (%T)", s.Name, s.Tags.String(), s.Value)
+	}
+
+	return e.appendLine(dst, s, "", val, ts), nil
+}
+
+// AppendFooter is a no-op, the plaintext protocol has no footer.
+func (GraphiteEncoder) AppendFooter(dst []byte) []byte {
+	return dst
+}
+
+// appendLine appends "path value timestamp\n", stat is appended to the metric
+// name of tagged series and to the end of dotted paths.
+func (e GraphiteEncoder) appendLine(dst []byte, s *Sample, stat string, val []byte, ts int64) []byte {
+	dst = append(dst, graphitePathReplacer.Replace(e.Prefix+s.Name)...)
+
+	if e.Tags {
+		if stat != "" {
+			dst = append(dst, '.')
+			dst = append(dst, stat...)
+		}
+		for _, t := range graphiteTags(s.Tags, true) {
+			dst = append(dst, ';')
+			dst = append(dst, t...)
+		}
+	} else {
+		for _, t := range graphiteTags(s.Tags, false) {
+			dst = append(dst, '.')
+			dst = append(dst, t...)
+		}
+		if stat != "" {
+			dst = append(dst, '.')
+			dst = append(dst, stat...)
+		}
+	}
+
+	dst = append(dst, ' ')
+	dst = append(dst, val...)
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, ts, 10)
+
+	return append(dst, '\n')
+}
+
+// graphiteTags returns sorted tags as tag=value (tagged) or category.value (dotted).
+func graphiteTags(tags Tags, tagged bool) []string {
+	list := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, t := range tags {
+		if t.Category == "" {
+			continue
+		}
+		name := normalizeCategory(t.Category)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		switch {
+		case tagged && t.Value == "":
+			continue // graphite tag values can not be empty
+		case tagged:
+			list = append(list, graphiteTagNameReplacer.Replace(name)+"="+graphiteTagValueReplacer.Replace(t.Value))
+		case t.Value == "":
+			list = append(list, graphiteDottedPart(name))
+		default:
+			list = append(list, graphiteDottedPart(name)+"."+graphiteDottedPart(t.Value))
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+func graphiteDottedPart(s string) string {
+	return strings.ReplaceAll(graphitePathReplacer.Replace(s), ".", "_")
+}
+
+func appendGraphiteFloat(dst []byte, v float64) ([]byte, bool) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return dst, false
+	}
+	return strconv.AppendFloat(dst, v, 'f', -1, 64), true
+}
+
+// SendGraphite sends current metrics to a Graphite Carbon plaintext listener
+// (e.g. "localhost:2003") over TCP, encoded with enc. Metrics are consumed
+// once the connection is established, as with WriteMetrics.
+func (tm *TrapMetrics) SendGraphite(ctx context.Context, addr string, enc GraphiteEncoder) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("graphite connect: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetWriteDeadline(deadline); err != nil {
+			return fmt.Errorf("graphite set deadline: %w", err)
+		}
+	}
+
+	w := bufio.NewWriter(conn)
+	if err := tm.WriteMetrics(w, enc); err != nil {
+		return fmt.Errorf("graphite write: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("graphite write: %w", err)
+	}
+
+	return nil
+}
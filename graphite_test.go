@@ -0,0 +1,132 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"context"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openhistogram/circonusllhist"
+)
+
+func TestGraphiteEncoder(t *testing.T) {
+	h := circonusllhist.New()
+	for i := 1; i <= 100; i++ {
+		_ = h.RecordValue(float64(i))
+	}
+	tags := Tags{{Category: "Host", Value: "web1.example"}, {Category: "dc", Value: "us east"}}
+
+	tests := []struct {
+		name    string
+		want    string
+		sample  Sample
+		encoder GraphiteEncoder
+		wantErr bool
+	}{
+		{
+			name:    "counter tagged",
+			encoder: GraphiteEncoder{Tags: true},
+			sample:  Sample{Name: "requests", Type: rtInt64, Value: int64(5), Tags: tags, Timestamp: 1631202930123, Flush: true},
+			want:    "requests;dc=us_east;host=web1.example 5 1631202930\n",
+		},
+		{
+			name:   "counter dotted",
+			sample: Sample{Name: "requests", Type: rtInt64, Value: int64(5), Tags: tags, Timestamp: 1631202930123, Flush: true},
+			want:   "requests.dc.us_east.host.web1_example 5 1631202930\n",
+		},
+		{
+			name:    "gauge prefix",
+			encoder: GraphiteEncoder{Prefix: "app."},
+			sample:  Sample{Name: "temp", Type: rtFloat64, Value: 21.5, Timestamp: 1631202930123},
+			want:    "app.temp 21.5 1631202930\n",
+		},
+		{
+			name:    "histogram tagged",
+			encoder: GraphiteEncoder{Tags: true, Quantiles: []float64{0.5, 0.999}},
+			sample:  Sample{Name: "latency", Type: rtHistogram, Value: h, Tags: Tags{{Category: "svc", Value: "api"}}, Timestamp: 1631202930123, Flush: true},
+			want:    "latency.count;svc=api 100 1631202930\nlatency.p50;svc=api 51 1631202930\nlatency.p99.9;svc=api 109.00000000000006 1631202930\n",
+		},
+		{
+			name:    "histogram dotted",
+			encoder: GraphiteEncoder{Quantiles: []float64{0.5}},
+			sample:  Sample{Name: "latency", Type: rtHistogram, Value: h, Tags: Tags{{Category: "svc", Value: "api"}}, Timestamp: 1631202930123, Flush: true},
+			want:    "latency.svc.api.count 100 1631202930\nlatency.svc.api.p50 51 1631202930\n",
+		},
+		{
+			name:   "text skipped",
+			sample: Sample{Name: "status", Type: rtString, Value: "ok", Timestamp: 1631202930123},
+			want:   "",
+		},
+		{
+			name:    "inf",
+			sample:  Sample{Name: "temp", Type: rtFloat64, Value: float32(math.Inf(1)), Timestamp: 1},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.encoder.AppendSample(nil, &tt.sample, true)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AppendSample() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("AppendSample() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrapMetrics_SendGraphite(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer ln.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		received <- string(data)
+	}()
+
+	tm, err := New(&Config{Trap: FakeTrap{}})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+	_ = tm.CounterIncrementByValue("requests", Tags{{Category: "svc", Value: "api"}}, 3)
+	_ = tm.GaugeSet("temp", nil, 21.5, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := tm.SendGraphite(ctx, ln.Addr().String(), GraphiteEncoder{Tags: true}); err != nil {
+		t.Fatalf("SendGraphite() error = %v", err)
+	}
+
+	got := <-received
+	for _, want := range []string{"requests;svc=api 3 ", "temp 21.5 "} {
+		if !strings.Contains(got, want) {
+			t.Errorf("received = %q, want %q", got, want)
+		}
+	}
+
+	if err := tm.SendGraphite(ctx, "127.0.0.1:1", GraphiteEncoder{}); err == nil {
+		t.Error("SendGraphite() expected connection error")
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/openhistogram/circonusllhist"
+)
+
+// CounterHandle is a counter with its metric ID resolved once, for use in hot paths
+// (e.g. per packet). Updates are accumulated with atomic operations (no locking or
+// allocation), safe for concurrent use, and added to the counter in the metric
+// store when metrics are flushed or fetched.
+type CounterHandle struct {
+	tm      *TrapMetrics
+	name    string
+	tags    Tags
+	id      uint64
+	pending int64
+}
+
+// GaugeHandle is a gauge with its metric ID resolved once, for use in hot paths.
+// The typed methods (SetFloat64, SetInt64, AddFloat64) update pending state held
+// in the handle (no hashing or allocation) which is applied to the gauge when
+// metrics are flushed or fetched.
+type GaugeHandle struct {
+	tm      *TrapMetrics
+	name    string
+	tags    Tags
+	id      uint64
+	pending gaugePending
+	mu      sync.Mutex
+}
+
+// gaugePending is the pending state of a gauge handle, the kind of set value
+// is kept with the value so they are always updated together.
+type gaugePending struct {
+	set   uint64 // float64 bits or int64 (see kind)
+	delta float64
+	kind  uint8
+}
+
+// gauge handle pending set value kinds
+const (
+	gaugeSetNone uint8 = iota
+	gaugeSetFloat64
+	gaugeSetInt64
+)
+
+// HistogramHandle is a histogram (or cumulative histogram) with its metric ID
+// resolved once, for use in hot paths. Recording does not allocate.
+type HistogramHandle struct {
+	tm         *TrapMetrics
+	name       string
+	tags       Tags
+	id         uint64
+	cumulative bool
+}
+
+// Counter returns a handle for the counter identified by name and tags. Handles
+// are kept for the life of the container, the same handle is returned for
+// repeated calls with the same name and tags.
+func (tm *TrapMetrics) Counter(name string, tags Tags) (*CounterHandle, error) {
+	id, err := tm.handleID(name, mtCounter, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	tm.handlesmu.Lock()
+	defer tm.handlesmu.Unlock()
+
+	if h, ok := tm.counterHandles[id]; ok {
+		return h, nil
+	}
+
+	h := &CounterHandle{tm: tm, id: id, name: name, tags: tags}
+	tm.counterHandles[id] = h
+
+	return h, nil
+}
+
+// Gauge returns a handle for the gauge identified by name and tags. Handles
+// are kept for the life of the container, the same handle is returned for
+// repeated calls with the same name and tags.
+func (tm *TrapMetrics) Gauge(name string, tags Tags) (*GaugeHandle, error) {
+	id, err := tm.handleID(name, mtGauge, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	tm.handlesmu.Lock()
+	defer tm.handlesmu.Unlock()
+
+	if h, ok := tm.gaugeHandles[id]; ok {
+		return h, nil
+	}
+
+	h := &GaugeHandle{tm: tm, id: id, name: name, tags: tags}
+	tm.gaugeHandles[id] = h
+
+	return h, nil
+}
+
+// Histogram returns a handle for the histogram identified by name and tags.
+func (tm *TrapMetrics) Histogram(name string, tags Tags) (*HistogramHandle, error) {
+	id, err := tm.handleID(name, mtHistogram, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HistogramHandle{tm: tm, id: id, name: name, tags: tags}, nil
+}
+
+// CumulativeHistogram returns a handle for the cumulative histogram identified by name and tags.
+func (tm *TrapMetrics) CumulativeHistogram(name string, tags Tags) (*HistogramHandle, error) {
+	id, err := tm.handleID(name, mtCumulativeHistogram, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HistogramHandle{tm: tm, id: id, name: name, tags: tags, cumulative: true}, nil
+}
+
+// handleID validates the metric and returns its ID.
+func (tm *TrapMetrics) handleID(name, mtype string, tags Tags) (uint64, error) {
+	id, err := generateMetricID(name, mtype, tags)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tm.newMetricWithID(id, name, mtype, tags); err != nil {
+		return 0, fmt.Errorf("(%s %s) invalid (%s): %w", name, tags.String(), mtype, err)
+	}
+
+	return id, nil
+}
+
+// Inc increments the counter by 1.
+func (h *CounterHandle) Inc() {
+	atomic.AddInt64(&h.pending, 1)
+}
+
+// Add increments the counter by the passed value.
+func (h *CounterHandle) Add(val uint64) {
+	atomic.AddInt64(&h.pending, int64(val))
+}
+
+// Adjust adjusts the counter by the passed value.
+func (h *CounterHandle) Adjust(val int64) {
+	atomic.AddInt64(&h.pending, val)
+}
+
+// fold adds any pending updates to the counter.
+func (h *CounterHandle) fold() error {
+	val := atomic.SwapInt64(&h.pending, 0)
+	if val == 0 {
+		return nil
+	}
+	if err := h.tm.counterAdd(h.id, h.name, h.tags, val); err != nil {
+		atomic.AddInt64(&h.pending, val)
+		return err
+	}
+
+	return nil
+}
+
+// foldHandles applies pending counter and gauge handle updates to their metrics.
+func (tm *TrapMetrics) foldHandles() {
+	tm.handlesmu.Lock()
+	defer tm.handlesmu.Unlock()
+
+	for _, h := range tm.counterHandles {
+		if err := h.fold(); err != nil {
+			tm.Log.Warnf("counter handle: %s", err)
+		}
+	}
+	for _, h := range tm.gaugeHandles {
+		if err := h.fold(); err != nil {
+			tm.Log.Warnf("gauge handle: %s", err)
+		}
+	}
+}
+
+// Set sets a sample with a given timestamp for the gauge to the passed value.
+func (h *GaugeHandle) Set(val interface{}, ts *time.Time) error {
+	return h.tm.gaugeSet(h.id, h.name, h.tags, val, ts)
+}
+
+// Add adds a sample with a given timestamp for the gauge to the passed value.
+func (h *GaugeHandle) Add(val interface{}, ts *time.Time) error {
+	return h.tm.gaugeAdd(h.id, h.name, h.tags, val, ts)
+}
+
+// SetFloat64 sets the gauge to the passed value, replacing any pending AddFloat64.
+func (h *GaugeHandle) SetFloat64(val float64) {
+	h.mu.Lock()
+	h.pending = gaugePending{set: math.Float64bits(val), kind: gaugeSetFloat64}
+	h.mu.Unlock()
+}
+
+// SetInt64 sets the gauge to the passed value, replacing any pending AddFloat64.
+func (h *GaugeHandle) SetInt64(val int64) {
+	h.mu.Lock()
+	h.pending = gaugePending{set: uint64(val), kind: gaugeSetInt64}
+	h.mu.Unlock()
+}
+
+// AddFloat64 adds the passed value to the gauge.
+func (h *GaugeHandle) AddFloat64(val float64) {
+	h.mu.Lock()
+	h.pending.delta += val
+	h.mu.Unlock()
+}
+
+// fold applies any pending updates to the gauge.
+func (h *GaugeHandle) fold() error {
+	h.mu.Lock()
+	p := h.pending
+	h.pending = gaugePending{}
+	h.mu.Unlock()
+
+	var val interface{}
+	switch p.kind {
+	case gaugeSetFloat64:
+		val = math.Float64frombits(p.set) + p.delta
+	case gaugeSetInt64:
+		if p.delta == 0 {
+			val = int64(p.set)
+		} else {
+			val = float64(int64(p.set)) + p.delta
+		}
+	default:
+		if p.delta == 0 {
+			return nil
+		}
+		return h.tm.gaugeAdd(h.id, h.name, h.tags, p.delta, nil)
+	}
+
+	return h.tm.gaugeSet(h.id, h.name, h.tags, val, nil)
+}
+
+// RecordValue adds a value to the histogram.
+func (h *HistogramHandle) RecordValue(val float64) error {
+	return h.tm.histogramRecord(h.id, h.name, h.tags, h.cumulative, func(s *circonusllhist.Histogram) {
+		_ = s.RecordValue(val)
+	})
+}
+
+// RecordDuration adds a duration to the histogram.
+func (h *HistogramHandle) RecordDuration(val time.Duration) error {
+	return h.tm.histogramRecord(h.id, h.name, h.tags, h.cumulative, func(s *circonusllhist.Histogram) {
+		_ = s.RecordDuration(val)
+	})
+}
+
+// RecordCountForValue adds count n for value to the histogram.
+func (h *HistogramHandle) RecordCountForValue(count int64, val float64) error {
+	return h.tm.histogramRecord(h.id, h.name, h.tags, h.cumulative, func(s *circonusllhist.Histogram) {
+		_ = s.RecordValues(val, count)
+	})
+}
@@ -0,0 +1,368 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openhistogram/circonusllhist"
+)
+
+func TestTrapMetrics_Handles(t *testing.T) {
+	tm, err := New(&Config{Trap: FakeTrap{}})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+
+	tags := Tags{{Category: "foo", Value: "bar"}}
+
+	c, err := tm.Counter("requests", tags)
+	if err != nil {
+		t.Fatalf("Counter() error = %v", err)
+	}
+	c.Inc()
+	c.Add(5)
+	c.Adjust(-2)
+	if err := tm.CounterIncrement("requests", tags); err != nil {
+		t.Fatalf("CounterIncrement() error = %v", err)
+	}
+
+	if c2, _ := tm.Counter("requests", tags); c2 != c {
+		t.Error("Counter() returned a different handle for the same counter")
+	}
+
+	m, err := tm.CounterFetch("requests", tags)
+	if err != nil {
+		t.Fatalf("CounterFetch() error = %v", err)
+	}
+	if v := m.Samples[0]; v != int64(5) {
+		t.Errorf("counter = %v, want 5", v)
+	}
+
+	g, err := tm.Gauge("temp", tags)
+	if err != nil {
+		t.Fatalf("Gauge() error = %v", err)
+	}
+	if err := g.Set(1.5, nil); err != nil {
+		t.Fatalf("GaugeHandle.Set() error = %v", err)
+	}
+	if err := g.Add(1.0, nil); err != nil {
+		t.Fatalf("GaugeHandle.Add() error = %v", err)
+	}
+	m, err = tm.GaugeFetch("temp", tags)
+	if err != nil {
+		t.Fatalf("GaugeFetch() error = %v", err)
+	}
+	if v := m.Samples[0]; v != 2.5 {
+		t.Errorf("gauge = %v, want 2.5", v)
+	}
+
+	if g2, _ := tm.Gauge("temp", tags); g2 != g {
+		t.Error("Gauge() returned a different handle for the same gauge")
+	}
+	for _, tt := range []struct {
+		update func()
+		want   interface{}
+	}{
+		{update: func() { g.AddFloat64(0.5) }, want: 3.0},
+		{update: func() { g.SetInt64(4) }, want: int64(4)},
+		{update: func() { g.SetInt64(4); g.AddFloat64(-1.5) }, want: 2.5},
+		{update: func() { g.AddFloat64(9); g.SetFloat64(1.25) }, want: 1.25},
+	} {
+		tt.update()
+		m, err = tm.GaugeFetch("temp", tags)
+		if err != nil {
+			t.Fatalf("GaugeFetch() error = %v", err)
+		}
+		if v := m.Samples[0]; v != tt.want {
+			t.Errorf("gauge = %v (%T), want %v (%T)", v, v, tt.want, tt.want)
+		}
+	}
+
+	h, err := tm.Histogram("latency", tags)
+	if err != nil {
+		t.Fatalf("Histogram() error = %v", err)
+	}
+	_ = h.RecordValue(1)
+	_ = h.RecordDuration(time.Second)
+	_ = h.RecordCountForValue(3, 2)
+	m, err = tm.HistogramFetch("latency", tags)
+	if err != nil {
+		t.Fatalf("HistogramFetch() error = %v", err)
+	}
+	if n := m.Samples[0].(*circonusllhist.Histogram).Count(); n != 5 {
+		t.Errorf("histogram count = %d, want 5", n)
+	}
+
+	if _, err := tm.Counter("", tags); err == nil {
+		t.Error("Counter() expected error for empty name")
+	}
+	if _, err := tm.Gauge("requests", tags); err != nil {
+		t.Errorf("Gauge() error = %v", err)
+	}
+	if err := tm.CounterIncrement("temp", tags); err != nil {
+		t.Errorf("CounterIncrement() error = %v", err)
+	}
+}
+
+func TestTrapMetrics_GaugeHandleConcurrent(t *testing.T) {
+	tm, err := New(&Config{Trap: FakeTrap{}})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+
+	g, err := tm.Gauge("temp", nil)
+	if err != nil {
+		t.Fatalf("Gauge() error = %v", err)
+	}
+
+	const (
+		writers = 4
+		updates = 2000
+	)
+
+	// concurrent sets of both kinds, every folded value is one of the values set
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < updates; j++ {
+				if i%2 == 0 {
+					g.SetInt64(7)
+				} else {
+					g.SetFloat64(1.5)
+				}
+			}
+		}(i)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for fetching := true; fetching; {
+		select {
+		case <-done:
+			fetching = false
+		default:
+		}
+		m, err := tm.GaugeFetch("temp", nil)
+		if err != nil {
+			continue
+		}
+		if v := m.Samples[0]; v != int64(7) && v != 1.5 {
+			t.Fatalf("gauge = %v (%T), want 7 (int64) or 1.5 (float64)", v, v)
+		}
+	}
+
+	// concurrent adds with folds, none are lost
+	g, err = tm.Gauge("load", nil)
+	if err != nil {
+		t.Fatalf("Gauge() error = %v", err)
+	}
+	g.SetFloat64(0)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < updates; j++ {
+				g.AddFloat64(1)
+			}
+		}()
+	}
+	done = make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for fetching := true; fetching; {
+		select {
+		case <-done:
+			fetching = false
+		default:
+		}
+		_, _ = tm.GaugeFetch("load", nil)
+	}
+
+	m, err := tm.GaugeFetch("load", nil)
+	if err != nil {
+		t.Fatalf("GaugeFetch() error = %v", err)
+	}
+	if v := m.Samples[0]; v != float64(writers*updates) {
+		t.Errorf("gauge = %v, want %d", v, writers*updates)
+	}
+}
+
+func TestTrapMetrics_HandleFlush(t *testing.T) {
+	tests := []struct {
+		cfg     Config
+		name    string
+		packets []string // value of the counter in each payload
+	}{
+		{
+			name:    "reset",
+			packets: []string{"1000", "1"},
+		},
+		{
+			name:    "persistent",
+			cfg:     Config{PersistentCounters: true},
+			packets: []string{"1000", "1001", "1001"},
+		},
+		{
+			name:    "retain idle",
+			cfg:     Config{RetainIdleIntervals: 1},
+			packets: []string{"1000", "1", "0"},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			trap := &RecordingTrap{}
+			cfg := tt.cfg
+			cfg.Trap = trap
+			tm, err := New(&cfg)
+			if err != nil {
+				t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+			}
+
+			c, err := tm.Counter("packets", nil)
+			if err != nil {
+				t.Fatalf("Counter() error = %v", err)
+			}
+			g, err := tm.Gauge("rtt", nil)
+			if err != nil {
+				t.Fatalf("Gauge() error = %v", err)
+			}
+
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 100; j++ {
+						c.Inc()
+					}
+				}()
+			}
+			wg.Wait()
+			g.SetFloat64(1.5)
+			g.AddFloat64(1)
+
+			// handle updates are kept in the metric store
+			if m, err := tm.CounterFetch("packets", nil); err != nil || m.Samples[0] != int64(1000) {
+				t.Errorf("CounterFetch() = %v, %v, want 1000", m, err)
+			}
+
+			for i := 0; i < 3; i++ {
+				if i == 1 {
+					c.Inc()
+				}
+				if _, err := tm.Flush(context.Background()); err != nil {
+					t.Fatalf("Flush() error = %v", err)
+				}
+			}
+
+			payloads := trap.Payloads()
+			if len(payloads) != len(tt.packets) {
+				t.Fatalf("got %d payloads, want %d", len(payloads), len(tt.packets))
+			}
+			for i, want := range tt.packets {
+				p := string(payloads[i])
+				if want := `"packets":{"_type":"l","_ts":`; !strings.Contains(p, want) {
+					t.Errorf("payload %d = %s, want %s", i, p, want)
+				}
+				if want := `"_value":"` + want + `"}`; !strings.Contains(p, want) {
+					t.Errorf("payload %d = %s, want %s", i, p, want)
+				}
+				gauge := strings.Contains(p, `"rtt":{"_type":"n","_ts":0,"_value":"2.500000"}`)
+				if gauge != (i == 0) {
+					t.Errorf("payload %d = %s, want gauge only in the first payload", i, p)
+				}
+			}
+		})
+	}
+}
+
+func TestTrapMetrics_HandleAllocs(t *testing.T) {
+	tm, err := New(&Config{Trap: FakeTrap{}})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+
+	tags := Tags{{Category: "foo", Value: "bar"}}
+	c, _ := tm.Counter("requests", tags)
+	g, _ := tm.Gauge("temp", tags)
+	h, _ := tm.Histogram("latency", tags)
+	_ = h.RecordValue(1)
+
+	if n := testing.AllocsPerRun(100, func() { c.Inc() }); n != 0 {
+		t.Errorf("CounterHandle.Inc() allocs = %v, want 0", n)
+	}
+	if n := testing.AllocsPerRun(100, func() { g.SetFloat64(1.5) }); n != 0 {
+		t.Errorf("GaugeHandle.SetFloat64() allocs = %v, want 0", n)
+	}
+	if n := testing.AllocsPerRun(100, func() { g.SetInt64(2) }); n != 0 {
+		t.Errorf("GaugeHandle.SetInt64() allocs = %v, want 0", n)
+	}
+	if n := testing.AllocsPerRun(100, func() { g.AddFloat64(0.5) }); n != 0 {
+		t.Errorf("GaugeHandle.AddFloat64() allocs = %v, want 0", n)
+	}
+	if n := testing.AllocsPerRun(100, func() { _ = h.RecordValue(1) }); n != 0 {
+		t.Errorf("HistogramHandle.RecordValue() allocs = %v, want 0", n)
+	}
+}
+
+func BenchmarkCounterHandleInc(b *testing.B) {
+	tm, _ := New(&Config{Trap: FakeTrap{}})
+	c, _ := tm.Counter("requests", Tags{{Category: "foo", Value: "bar"}})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Inc()
+	}
+}
+
+func BenchmarkCounterIncrement(b *testing.B) {
+	tm, _ := New(&Config{Trap: FakeTrap{}})
+	tags := Tags{{Category: "foo", Value: "bar"}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = tm.CounterIncrement("requests", tags)
+	}
+}
+
+func BenchmarkHistogramHandleRecordValue(b *testing.B) {
+	tm, _ := New(&Config{Trap: FakeTrap{}})
+	h, _ := tm.Histogram("latency", Tags{{Category: "foo", Value: "bar"}})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = h.RecordValue(float64(i % 1000))
+	}
+}
+
+func BenchmarkCounterHandleIncParallel(b *testing.B) {
+	tm, _ := New(&Config{Trap: FakeTrap{}})
+	c, _ := tm.Counter("packets", nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.Inc()
+		}
+	})
+}
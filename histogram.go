@@ -41,10 +41,11 @@ func (tm *TrapMetrics) HistogramFetch(name string, tags Tags) (*Metric, error) {
 		return nil, err
 	}
 
-	tm.metricsmu.Lock()
-	defer tm.metricsmu.Unlock()
+	sh := tm.metrics.shard(metricID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	if m, ok := tm.metrics[metricID]; ok {
+	if m, ok := sh.metrics[metricID]; ok {
 		return m, nil
 	}
 
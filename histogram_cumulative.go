@@ -5,7 +5,10 @@
 
 package trapmetrics
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 //
 // Cumulative need to be explicit
@@ -13,8 +16,28 @@ import "fmt"
 
 // Note: histograms don't take timestamps as they already contain multiple samples
 //       when they are flushed and serialized the current timestamp is used.
+//       Cumulative histograms are not reset when flushed, bucket counts keep
+//       growing for the lifetime of the container.
+
+// CumulativeHistogramRecordTiming adds timing value to histogram.
+func (tm *TrapMetrics) CumulativeHistogramRecordTiming(name string, tags Tags, val float64) error {
+	return tm.setValue(name, tags, true, val)
+}
+
+// CumulativeHistogramRecordValue adds value to histogram.
+func (tm *TrapMetrics) CumulativeHistogramRecordValue(name string, tags Tags, val float64) error {
+	return tm.setValue(name, tags, true, val)
+}
+
+// CumulativeHistogramRecordDuration adds value to histogram
+// (duration is normalized to time.Second, but supports nanosecond granularity).
+func (tm *TrapMetrics) CumulativeHistogramRecordDuration(name string, tags Tags, val time.Duration) error {
+	return tm.setDuration(name, tags, true, val)
+}
 
 // CumulativeHistogramRecordCountForValue add count n for value to histogram.
+// NOTE: the count is added to the running total, to submit per-interval counts
+// use HistogramRecordCountForValue.
 func (tm *TrapMetrics) CumulativeHistogramRecordCountForValue(name string, tags Tags, count int64, val float64) error {
 	return tm.setCountForValue(name, tags, true, count, val)
 }
@@ -26,28 +49,13 @@ func (tm *TrapMetrics) CumulativeHistogramFetch(name string, tags Tags) (*Metric
 		return nil, err
 	}
 
-	tm.metricsmu.Lock()
-	defer tm.metricsmu.Unlock()
+	sh := tm.metrics.shard(metricID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	if m, ok := tm.metrics[metricID]; ok {
+	if m, ok := sh.metrics[metricID]; ok {
 		return m, nil
 	}
 
 	return nil, fmt.Errorf("cumulative histogram %d (%s %s) not found", metricID, name, tags.String())
 }
-
-// CumulativeHistogramTiming adds timing value to histogram
-// func (tm *TrapMetrics) CumulativeHistogramRecordTiming(name string, tags Tags, val float64) error {
-// 	return tm.setValue(name, tags, true, val)
-// }
-
-// CumulativeHistogramRecordValue adds value to histogram
-// func (tm *TrapMetrics) CumulativeHistogramRecordValue(name string, tags Tags, val float64) error {
-// 	return tm.setValue(name, tags, true, val)
-// }
-
-// CumulativeHistogramRecordDuration adds value to histogram
-// (duration is normalized to time.Second, but supports nanosecond granularity)
-// func (tm *TrapMetrics) CumulativeHistogramRecordDuration(name string, tags Tags, val time.Duration) error {
-// 	return tm.setDuration(name, tags, true, val)
-// }
@@ -0,0 +1,96 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrapMetrics_CumulativeHistogram(t *testing.T) {
+	tests := []struct {
+		name   string
+		record func(tm *TrapMetrics) error
+	}{
+		{"value", func(tm *TrapMetrics) error { return tm.CumulativeHistogramRecordValue("test", nil, 3.14) }},
+		{"timing", func(tm *TrapMetrics) error { return tm.CumulativeHistogramRecordTiming("test", nil, 3.14) }},
+		{"duration", func(tm *TrapMetrics) error {
+			return tm.CumulativeHistogramRecordDuration("test", nil, 3140*time.Millisecond)
+		}},
+		{"count for value", func(tm *TrapMetrics) error {
+			return tm.CumulativeHistogramRecordCountForValue("test", nil, 1, 3.14)
+		}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tm, err := New(&Config{Trap: FakeTrap{}})
+			if err != nil {
+				t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+			}
+
+			// bucket counts keep growing across flushes
+			for i, want := range []uint64{1, 2, 2} {
+				if i < 2 {
+					if err := tt.record(tm); err != nil {
+						t.Fatalf("record error = %v", err)
+					}
+				}
+
+				jm, err := tm.JSONMetrics()
+				if err != nil {
+					t.Fatalf("flushing metrics: %s", err)
+				}
+				if !strings.Contains(string(jm), `"_type":"H"`) {
+					t.Errorf("flush %d json metrics want cumulative histogram got [%v]", i, string(jm))
+				}
+
+				v, err := tm.CumulativeHistogramView("test", nil)
+				if err != nil {
+					t.Fatalf("CumulativeHistogramView() error = %v", err)
+				}
+				if got := v.Count(); got != want {
+					t.Errorf("flush %d count = %d, want %d", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTrapMetrics_CumulativeHistogramRestore(t *testing.T) {
+	trap := &RecordingTrap{}
+	trap.setErr(errors.New("broker unavailable"))
+	tm, err := New(&Config{Trap: trap, RestoreOnFailure: true})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+
+	if err := tm.CumulativeHistogramRecordValue("test", nil, 1); err != nil {
+		t.Fatalf("CumulativeHistogramRecordValue() error = %v", err)
+	}
+	if err := tm.HistogramRecordValue("test", nil, 1); err != nil {
+		t.Fatalf("HistogramRecordValue() error = %v", err)
+	}
+
+	// failed submission, the histogram is restored, the cumulative histogram never left
+	if _, err := tm.Flush(context.Background()); err == nil {
+		t.Fatal("Flush() expected error")
+	}
+
+	for _, fetch := range []func(string, Tags) (*HistogramView, error){tm.HistogramView, tm.CumulativeHistogramView} {
+		v, err := fetch("test", nil)
+		if err != nil {
+			t.Fatalf("view error = %v", err)
+		}
+		if got := v.Count(); got != 1 {
+			t.Errorf("count = %d, want 1", got)
+		}
+	}
+}
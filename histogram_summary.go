@@ -0,0 +1,125 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"fmt"
+
+	"github.com/openhistogram/circonusllhist"
+)
+
+const summaryStatCategory = "stat"
+
+var defaultSummaryQuantiles = []float64{0.5, 0.9, 0.99}
+
+// HistogramSummaryConfig defines the gauges derived from a histogram at flush,
+// for consumers which can not read histograms. Each gauge has the name and tags
+// of the histogram plus a stat tag - stat:count, stat:mean and a tag for each
+// quantile (e.g. stat:p99). Values are approximations derived from the histogram bins.
+type HistogramSummaryConfig struct {
+	// Quantiles emitted as gauges (default: 0.5, 0.9, 0.99)
+	Quantiles []float64
+	// Replace only the gauges are submitted, otherwise they are submitted
+	// alongside the histogram
+	Replace bool
+	// Disable the histogram is not summarized, to opt individual histograms out
+	// of Config.HistogramSummary with SummarizeHistogram (other fields are ignored)
+	Disable bool
+}
+
+// summaryGauge is a single gauge derived from a histogram.
+type summaryGauge struct {
+	value interface{}
+	stat  string
+	rtype string
+}
+
+// SummarizeHistogram sets the summary gauges for the histogram (and cumulative
+// histogram) identified by name and tags, overriding Config.HistogramSummary.
+// A cfg with Disable set turns summarizing off for the histogram. A nil cfg
+// removes the setting, the histogram is then summarized as configured by
+// Config.HistogramSummary.
+func (tm *TrapMetrics) SummarizeHistogram(name string, tags Tags, cfg *HistogramSummaryConfig) error {
+	if err := validateSummaryConfig(cfg); err != nil {
+		return fmt.Errorf("(%s %s): %w", name, tags.String(), err)
+	}
+
+	ids := make([]uint64, 0, 2)
+	for _, mt := range []string{mtHistogram, mtCumulativeHistogram} {
+		id, err := generateMetricID(name, mt, tags)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+
+	tm.summarymu.Lock()
+	defer tm.summarymu.Unlock()
+
+	for _, id := range ids {
+		if cfg == nil {
+			delete(tm.histogramSummaries, id)
+			continue
+		}
+		tm.histogramSummaries[id] = cfg
+	}
+
+	return nil
+}
+
+// histogramSummaryConfig returns the summary config for a histogram, nil if it is not summarized.
+func (tm *TrapMetrics) histogramSummaryConfig(metricID uint64) *HistogramSummaryConfig {
+	tm.summarymu.RLock()
+	defer tm.summarymu.RUnlock()
+
+	cfg, ok := tm.histogramSummaries[metricID]
+	if !ok {
+		cfg = tm.histogramSummary
+	}
+	if cfg != nil && cfg.Disable {
+		return nil
+	}
+
+	return cfg
+}
+
+// summaryGauges returns the gauges derived from a histogram, only the count
+// for an empty histogram.
+func summaryGauges(h *circonusllhist.Histogram, cfg *HistogramSummaryConfig) ([]summaryGauge, error) {
+	quantiles := cfg.Quantiles
+	if len(quantiles) == 0 {
+		quantiles = defaultSummaryQuantiles
+	}
+
+	stats, err := summarizeHistogram(h, quantiles)
+	if err != nil {
+		return nil, err
+	}
+
+	gauges := []summaryGauge{{stat: "count", value: stats.Count, rtype: rtUint64}}
+	if stats.Count == 0 {
+		return gauges, nil
+	}
+
+	gauges = append(gauges, summaryGauge{stat: "mean", value: stats.Mean, rtype: rtFloat64})
+	for i, q := range quantiles {
+		gauges = append(gauges, summaryGauge{stat: quantileName(q), value: stats.Quantiles[i], rtype: rtFloat64})
+	}
+
+	return gauges, nil
+}
+
+func validateSummaryConfig(cfg *HistogramSummaryConfig) error {
+	if cfg == nil {
+		return nil
+	}
+	for _, q := range cfg.Quantiles {
+		if q < 0 || q > 1 {
+			return fmt.Errorf("invalid summary quantile (%v)", q)
+		}
+	}
+	return nil
+}
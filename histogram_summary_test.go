@@ -0,0 +1,200 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/openhistogram/circonusllhist"
+)
+
+// statEncoder writes one "kind name tags type" line per sample, with the value for uint64 samples.
+type statEncoder struct{}
+
+func (statEncoder) AppendHeader(dst []byte) []byte { return dst }
+func (statEncoder) AppendFooter(dst []byte) []byte { return dst }
+func (statEncoder) AppendSample(dst []byte, s *Sample, _ bool) ([]byte, error) {
+	line := fmt.Sprintf("%s %s %s %s", s.MetricType, s.Name, s.Tags.String(), s.Type)
+	if v, ok := s.Value.(uint64); ok {
+		line += fmt.Sprintf(" %d", v)
+	}
+	return append(dst, line+"\n"...), nil
+}
+
+func TestTrapMetrics_HistogramSummary(t *testing.T) {
+	tests := []struct {
+		global    *HistogramSummaryConfig
+		perMetric map[string]*HistogramSummaryConfig
+		name      string
+		want      []string
+	}{
+		{
+			name: "disabled",
+			want: []string{
+				"histogram a  h",
+				"histogram b  h",
+			},
+		},
+		{
+			name:   "global",
+			global: &HistogramSummaryConfig{Quantiles: []float64{0.99}},
+			want: []string{
+				"gauge a stat:count L 100",
+				"gauge a stat:mean n",
+				"gauge a stat:p99 n",
+				"gauge b stat:count L 1",
+				"gauge b stat:mean n",
+				"gauge b stat:p99 n",
+				"histogram a  h",
+				"histogram b  h",
+			},
+		},
+		{
+			name:   "global replace",
+			global: &HistogramSummaryConfig{Replace: true},
+			want: []string{
+				"gauge a stat:count L 100",
+				"gauge a stat:mean n",
+				"gauge a stat:p50 n",
+				"gauge a stat:p90 n",
+				"gauge a stat:p99 n",
+				"gauge b stat:count L 1",
+				"gauge b stat:mean n",
+				"gauge b stat:p50 n",
+				"gauge b stat:p90 n",
+				"gauge b stat:p99 n",
+			},
+		},
+		{
+			name:      "per metric",
+			perMetric: map[string]*HistogramSummaryConfig{"a": {Quantiles: []float64{0.999}, Replace: true}},
+			want: []string{
+				"gauge a stat:count L 100",
+				"gauge a stat:mean n",
+				"gauge a stat:p99.9 n",
+				"histogram b  h",
+			},
+		},
+		{
+			name:      "per metric disabled",
+			global:    &HistogramSummaryConfig{Replace: true},
+			perMetric: map[string]*HistogramSummaryConfig{"a": {Disable: true}},
+			want: []string{
+				"gauge b stat:count L 1",
+				"gauge b stat:mean n",
+				"gauge b stat:p50 n",
+				"gauge b stat:p90 n",
+				"gauge b stat:p99 n",
+				"histogram a  h",
+			},
+		},
+		{
+			name:      "per metric overrides global",
+			global:    &HistogramSummaryConfig{Quantiles: []float64{0.5}, Replace: true},
+			perMetric: map[string]*HistogramSummaryConfig{"b": {Quantiles: []float64{0.9}}},
+			want: []string{
+				"gauge a stat:count L 100",
+				"gauge a stat:mean n",
+				"gauge a stat:p50 n",
+				"gauge b stat:count L 1",
+				"gauge b stat:mean n",
+				"gauge b stat:p90 n",
+				"histogram b  h",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tm, err := New(&Config{Trap: FakeTrap{}, HistogramSummary: tt.global})
+			if err != nil {
+				t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+			}
+			for name, cfg := range tt.perMetric {
+				if err := tm.SummarizeHistogram(name, nil, cfg); err != nil {
+					t.Fatalf("SummarizeHistogram() error = %v", err)
+				}
+			}
+
+			for i := 1; i <= 100; i++ {
+				_ = tm.HistogramRecordValue("a", nil, float64(i))
+			}
+			_ = tm.HistogramRecordValue("b", nil, 1)
+
+			var buf bytes.Buffer
+			if err := tm.WriteMetrics(&buf, statEncoder{}); err != nil {
+				t.Fatalf("WriteMetrics() error = %v", err)
+			}
+
+			got := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			sort.Strings(got)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("samples\ngot:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestTrapMetrics_HistogramSummaryJSON(t *testing.T) {
+	tm, err := New(&Config{Trap: FakeTrap{}, HistogramSummary: &HistogramSummaryConfig{Replace: true}})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+
+	tags := Tags{{Category: "path", Value: "/"}}
+	if err := tm.CumulativeHistogramRecordCountForValue("latency", tags, 4, 1.5); err != nil {
+		t.Fatalf("CumulativeHistogramRecordCountForValue() error = %v", err)
+	}
+
+	jm, err := tm.JSONMetrics()
+	if err != nil {
+		t.Fatalf("JSONMetrics() error = %v", err)
+	}
+
+	count := Tags{{Category: "path", Value: "/"}, {Category: summaryStatCategory, Value: "count"}}
+	want := strconv.Quote("latency"+count.Stream()) + `:{"_type":"L",`
+	if !strings.Contains(string(jm), want) {
+		t.Errorf("json metrics want [%s] got [%s]", want, string(jm))
+	}
+	if !strings.Contains(string(jm), `"_value":"4"}`) {
+		t.Errorf("json metrics want count 4 got [%s]", string(jm))
+	}
+	if strings.Contains(string(jm), `"_type":"H"`) {
+		t.Errorf("json metrics want histogram replaced got [%s]", string(jm))
+	}
+}
+
+func TestHistogramSummaryConfig_Invalid(t *testing.T) {
+	cfg := &HistogramSummaryConfig{Quantiles: []float64{1.5}}
+
+	if _, err := New(&Config{Trap: FakeTrap{}, HistogramSummary: cfg}); err == nil {
+		t.Error("New() expected error for invalid quantile")
+	}
+
+	tm, err := New(&Config{Trap: FakeTrap{}})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+	if err := tm.SummarizeHistogram("a", nil, cfg); err == nil {
+		t.Error("SummarizeHistogram() expected error for invalid quantile")
+	}
+}
+
+func TestSummaryGauges_Empty(t *testing.T) {
+	gauges, err := summaryGauges(circonusllhist.New(), &HistogramSummaryConfig{})
+	if err != nil {
+		t.Fatalf("summaryGauges() error = %v", err)
+	}
+	if len(gauges) != 1 || gauges[0].stat != "count" || gauges[0].value != uint64(0) {
+		t.Errorf("summaryGauges() = %v, want count 0 only", gauges)
+	}
+}
@@ -7,6 +7,10 @@ package trapmetrics
 
 import (
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/openhistogram/circonusllhist"
@@ -17,77 +21,283 @@ import (
 //
 
 func (tm *TrapMetrics) setValue(name string, tags Tags, cumulative bool, val float64) error {
-	tm.metricsmu.Lock()
-	defer tm.metricsmu.Unlock()
-
-	m, err := tm.newHistogram(name, tags, cumulative)
+	metricID, err := histogramMetricID(name, tags, cumulative)
 	if err != nil {
 		return err
 	}
 
-	if s, ok := m.Samples[0].(*circonusllhist.Histogram); ok {
-		_ = s.RecordValue(val)
-	}
-
-	return nil
+	return tm.histogramRecord(metricID, name, tags, cumulative, func(h *circonusllhist.Histogram) {
+		_ = h.RecordValue(val)
+	})
 }
 
 func (tm *TrapMetrics) setDuration(name string, tags Tags, cumulative bool, val time.Duration) error {
-	tm.metricsmu.Lock()
-	defer tm.metricsmu.Unlock()
-
-	m, err := tm.newHistogram(name, tags, cumulative)
+	metricID, err := histogramMetricID(name, tags, cumulative)
 	if err != nil {
 		return err
 	}
 
-	if s, ok := m.Samples[0].(*circonusllhist.Histogram); ok {
-		_ = s.RecordDuration(val)
+	return tm.histogramRecord(metricID, name, tags, cumulative, func(h *circonusllhist.Histogram) {
+		_ = h.RecordDuration(val)
+	})
+}
+
+func (tm *TrapMetrics) setCountForValue(name string, tags Tags, cumulative bool, count int64, val float64) error {
+	metricID, err := histogramMetricID(name, tags, cumulative)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return tm.histogramRecord(metricID, name, tags, cumulative, func(h *circonusllhist.Histogram) {
+		_ = h.RecordValues(val, count)
+	})
 }
 
-func (tm *TrapMetrics) setCountForValue(name string, tags Tags, cumulative bool, count int64, val float64) error {
-	tm.metricsmu.Lock()
-	defer tm.metricsmu.Unlock()
+// histogramRecord calls record with the histogram identified by metricID, creating it if needed.
+func (tm *TrapMetrics) histogramRecord(metricID uint64, name string, tags Tags, cumulative bool, record func(*circonusllhist.Histogram)) error {
+	sh := tm.metrics.shard(metricID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	m, err := tm.newHistogram(name, tags, cumulative)
+	m, err := tm.newHistogram(sh, metricID, name, tags, cumulative)
 	if err != nil {
 		return err
 	}
 
 	if s, ok := m.Samples[0].(*circonusllhist.Histogram); ok {
-		_ = s.RecordValues(val, count)
+		record(s)
 	}
 
 	return nil
 }
 
-func (tm *TrapMetrics) newHistogram(name string, tags Tags, cumulative bool) (*Metric, error) {
+func histogramMetricID(name string, tags Tags, cumulative bool) (uint64, error) {
+	if cumulative {
+		return generateMetricID(name, mtCumulativeHistogram, tags)
+	}
+	return generateMetricID(name, mtHistogram, tags)
+}
+
+// newHistogram returns the histogram from the shard, creating it if needed. Caller must hold sh.mu.
+func (tm *TrapMetrics) newHistogram(sh *metricShard, metricID uint64, name string, tags Tags, cumulative bool) (*Metric, error) {
+	if m, ok := sh.metrics[metricID]; ok {
+		return m, nil
+	}
+
 	mt := mtHistogram
 	rt := rtHistogram
 	if cumulative {
 		mt = mtCumulativeHistogram
 		rt = rtCumulativeHistogram
 	}
-	metricID, err := generateMetricID(name, mt, tags)
-	if err != nil {
-		return nil, err
-	}
 
-	if m, ok := tm.metrics[metricID]; ok {
-		return m, nil
-	}
-
-	m, err := tm.newMetric(name, mt, tags)
+	m, err := tm.newMetricWithID(metricID, name, mt, tags)
 	if err != nil {
 		return nil, fmt.Errorf("(%s %s) failed to initialize (histogram): %w", name, tags.String(), err)
 	}
 	m.Rtype = rt
 	m.Samples[0] = circonusllhist.New()
 
-	tm.metrics[metricID] = m
+	sh.metrics[metricID] = m
 
 	return m, nil
 }
+
+// copyHistogram returns a copy of a histogram.
+// NOTE: circonusllhist.Histogram.Copy clears the bins of the source histogram
+// (copy arguments are reversed), merging into a new histogram is safe.
+func copyHistogram(h *circonusllhist.Histogram) *circonusllhist.Histogram {
+	c := circonusllhist.New()
+	c.Merge(h)
+	return c
+}
+
+// histogramDelta returns a histogram of the samples recorded in cur since prev.
+// Returns false if any bin of cur has fewer samples than prev (cur was reset).
+func histogramDelta(cur, prev *circonusllhist.Histogram) (*circonusllhist.Histogram, bool) {
+	prevCounts := make(map[string]uint64)
+	for _, bin := range prev.DecStrings() {
+		val, count, err := splitHistogramBin(bin)
+		if err != nil {
+			return nil, false
+		}
+		prevCounts[val] = count
+	}
+
+	delta := circonusllhist.New()
+	for _, bin := range cur.DecStrings() {
+		val, count, err := splitHistogramBin(bin)
+		if err != nil {
+			return nil, false
+		}
+		last := prevCounts[val]
+		delete(prevCounts, val)
+		if count < last {
+			return nil, false
+		}
+		if count == last {
+			continue
+		}
+		mantissa, exp, err := histogramBinScale(val)
+		if err != nil {
+			return nil, false
+		}
+		// bins hold two significant digits, mantissa 12 exp 0 is 1.2e+00
+		delta.RecordIntScales(mantissa, exp-1, int64(count-last))
+	}
+
+	return delta, len(prevCounts) == 0
+}
+
+// splitHistogramBin splits a bin in circonusllhist decimal string form (H[1.2e+00]=3)
+// into its value (1.2e+00) and count.
+func splitHistogramBin(bin string) (string, uint64, error) {
+	parts := strings.SplitN(strings.TrimPrefix(bin, "H["), "]=", 2)
+	if len(parts) != 2 {
+		return "", 0, fmt.Errorf("invalid histogram bin (%s)", bin)
+	}
+
+	count, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid histogram bin count (%s): %w", bin, err)
+	}
+
+	return parts[0], count, nil
+}
+
+// histogramBinScale returns the two digit mantissa and exponent of a bin value (1.2e+00 -> 12, 0).
+func histogramBinScale(val string) (int64, int, error) {
+	parts := strings.SplitN(val, "e", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid histogram bin value (%s)", val)
+	}
+
+	mantissa, err := strconv.ParseInt(strings.Replace(parts[0], ".", "", 1), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid histogram bin value (%s): %w", val, err)
+	}
+	exp, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid histogram bin value (%s): %w", val, err)
+	}
+
+	return mantissa, exp, nil
+}
+
+// summarizeHistogram returns the count, sum, mean, min, max and the values at
+// quantiles (0..1, in any order) of a histogram. An empty histogram only has a count.
+func summarizeHistogram(h *circonusllhist.Histogram, quantiles []float64) (HistogramSummary, error) {
+	stats := HistogramSummary{Count: h.Count()}
+	if stats.Count == 0 {
+		return stats, nil
+	}
+
+	// min and max are included so the quantiles are computed in a single pass
+	qs := make([]float64, 0, len(quantiles)+2)
+	qs = append(qs, 0, 1)
+	qs = append(qs, quantiles...)
+	sorted := append([]float64{}, qs...)
+	sort.Float64s(sorted)
+
+	vals, err := h.ApproxQuantile(sorted)
+	if err != nil {
+		return stats, fmt.Errorf("histogram quantiles: %w", err)
+	}
+
+	valueAt := func(q float64) float64 {
+		return vals[sort.SearchFloat64s(sorted, q)]
+	}
+
+	stats.Sum = h.ApproxSum()
+	stats.Mean = h.ApproxMean()
+	stats.Min = valueAt(0)
+	stats.Max = valueAt(1)
+	stats.Quantiles = make([]float64, len(quantiles))
+	for i, q := range quantiles {
+		stats.Quantiles[i] = valueAt(q)
+	}
+
+	return stats, nil
+}
+
+// quantileName returns the name of a quantile as a percentile (e.g. 0.99 -> p99, 0.999 -> p99.9).
+func quantileName(q float64) string {
+	return "p" + strconv.FormatFloat(math.Round(q*1e6)/1e4, 'f', -1, 64)
+}
+
+// histogramBuckets returns the bins of a histogram as buckets, ordered by upper bound.
+func histogramBuckets(h *circonusllhist.Histogram) []HistogramBucket {
+	bins := h.DecStrings()
+	buckets := make([]HistogramBucket, 0, len(bins))
+	for _, bin := range bins {
+		b, err := parseHistogramBin(bin)
+		if err != nil {
+			continue
+		}
+		buckets = append(buckets, b)
+	}
+
+	sort.SliceStable(buckets, func(i, j int) bool {
+		return buckets[i].Upper < buckets[j].Upper
+	})
+
+	return buckets
+}
+
+// parseHistogramBin converts a bin in circonusllhist decimal string form (H[1.2e+00]=3)
+// to a bucket. Bins hold two significant digits, so H[1.2e+00] covers [1.2,1.3) and
+// H[-1.2e+00] covers (-1.3,-1.2].
+func parseHistogramBin(bin string) (HistogramBucket, error) {
+	var b HistogramBucket
+
+	parts := strings.SplitN(strings.TrimPrefix(bin, "H["), "]=", 2)
+	if len(parts) != 2 {
+		return b, fmt.Errorf("invalid histogram bin (%s)", bin)
+	}
+
+	count, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return b, fmt.Errorf("invalid histogram bin count (%s): %w", bin, err)
+	}
+	b.Count = count
+
+	val, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return b, fmt.Errorf("invalid histogram bin value (%s): %w", bin, err)
+	}
+	if val == 0 || math.IsNaN(val) {
+		b.Lower, b.Upper = val, val
+		return b, nil
+	}
+
+	valExp := strings.SplitN(parts[0], "e", 2)
+	if len(valExp) != 2 {
+		return b, fmt.Errorf("invalid histogram bin value (%s)", bin)
+	}
+	e, err := strconv.Atoi(valExp[1])
+	if err != nil {
+		return b, fmt.Errorf("invalid histogram bin exponent (%s): %w", bin, err)
+	}
+	digits, err := strconv.Atoi(strings.Replace(valExp[0], ".", "", 1))
+	if err != nil {
+		return b, fmt.Errorf("invalid histogram bin mantissa (%s): %w", bin, err)
+	}
+
+	// parse the adjacent edge from its decimal form so it is as exact as the bin value itself
+	next := digits + 1
+	if digits < 0 {
+		next = digits - 1
+	}
+	edge, err := strconv.ParseFloat(strconv.Itoa(next)+"e"+strconv.Itoa(e-1), 64)
+	if err != nil {
+		return b, fmt.Errorf("invalid histogram bin (%s): %w", bin, err)
+	}
+
+	if val > 0 {
+		b.Lower, b.Upper = val, edge
+	} else {
+		b.Lower, b.Upper = edge, val
+	}
+
+	return b, nil
+}
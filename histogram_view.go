@@ -0,0 +1,150 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"fmt"
+
+	"github.com/openhistogram/circonusllhist"
+)
+
+// HistogramSummary is a summary of a histogram.
+type HistogramSummary struct {
+	Quantiles []float64 // values at the requested quantiles, in the order requested
+	Count     uint64
+	Sum       float64
+	Mean      float64
+	Min       float64
+	Max       float64
+}
+
+// HistogramBucket is the range and count of a single histogram bin.
+type HistogramBucket struct {
+	Lower float64
+	Upper float64
+	Count uint64
+}
+
+// HistogramView is a point in time copy of a histogram metric with typed
+// accessors, e.g. to log or alert on local percentiles before metrics are
+// flushed. Values are approximations derived from the histogram bins, the
+// sum, mean, min and max of an empty histogram are 0.
+type HistogramView struct {
+	h    *circonusllhist.Histogram
+	Name string
+	Tags Tags
+}
+
+// HistogramView returns a view of the histogram identified by name and tags.
+func (tm *TrapMetrics) HistogramView(name string, tags Tags) (*HistogramView, error) {
+	m, err := tm.HistogramFetch(name, tags)
+	if err != nil {
+		return nil, err
+	}
+	return m.HistogramView()
+}
+
+// CumulativeHistogramView returns a view of the cumulative histogram identified by name and tags.
+func (tm *TrapMetrics) CumulativeHistogramView(name string, tags Tags) (*HistogramView, error) {
+	m, err := tm.CumulativeHistogramFetch(name, tags)
+	if err != nil {
+		return nil, err
+	}
+	return m.HistogramView()
+}
+
+// HistogramView returns a view of a histogram metric (e.g. from HistogramFetch)
+// or an error if the metric is not a histogram.
+func (m *Metric) HistogramView() (*HistogramView, error) {
+	if m.Mtype != mtHistogram && m.Mtype != mtCumulativeHistogram {
+		return nil, fmt.Errorf("(%s %s) not a histogram (%s)", m.Name, m.Tags.String(), m.Mtype)
+	}
+
+	h, ok := m.Samples[0].(*circonusllhist.Histogram)
+	if !ok {
+		return nil, fmt.Errorf("(%s %s) invalid histogram sample (%T)", m.Name, m.Tags.String(), m.Samples[0])
+	}
+
+	return &HistogramView{
+		Name: m.Name,
+		Tags: m.Tags,
+		h:    copyHistogram(h),
+	}, nil
+}
+
+// Count returns the number of recorded values.
+func (v *HistogramView) Count() uint64 {
+	return v.h.Count()
+}
+
+// Sum returns the sum of the recorded values.
+func (v *HistogramView) Sum() float64 {
+	return v.summary().Sum
+}
+
+// Mean returns the mean of the recorded values.
+func (v *HistogramView) Mean() float64 {
+	return v.summary().Mean
+}
+
+// Min returns the minimum recorded value.
+func (v *HistogramView) Min() float64 {
+	return v.summary().Min
+}
+
+// Max returns the maximum recorded value.
+func (v *HistogramView) Max() float64 {
+	return v.summary().Max
+}
+
+// Quantile returns the value at quantile q (0..1, e.g. 0.99 for p99).
+func (v *HistogramView) Quantile(q float64) (float64, error) {
+	vals, err := v.Quantiles(q)
+	if err != nil {
+		return 0, err
+	}
+	return vals[0], nil
+}
+
+// Quantiles returns the values at quantiles (0..1, in any order), in the order requested.
+func (v *HistogramView) Quantiles(quantiles ...float64) ([]float64, error) {
+	s, err := v.Summary(quantiles...)
+	if err != nil {
+		return nil, err
+	}
+	if s.Count == 0 {
+		return nil, fmt.Errorf("(%s %s) histogram is empty", v.Name, v.Tags.String())
+	}
+	return s.Quantiles, nil
+}
+
+// Summary returns the count, sum, mean, min, max and the values at quantiles
+// (0..1, in any order) of the histogram. Quantiles are not set for an empty histogram.
+func (v *HistogramView) Summary(quantiles ...float64) (HistogramSummary, error) {
+	for _, q := range quantiles {
+		if q < 0 || q > 1 {
+			return HistogramSummary{}, fmt.Errorf("(%s %s) invalid quantile (%v)", v.Name, v.Tags.String(), q)
+		}
+	}
+
+	s, err := summarizeHistogram(v.h, quantiles)
+	if err != nil {
+		return HistogramSummary{}, fmt.Errorf("(%s %s): %w", v.Name, v.Tags.String(), err)
+	}
+
+	return s, nil
+}
+
+// Buckets returns the histogram bins, ordered by upper bound.
+func (v *HistogramView) Buckets() []HistogramBucket {
+	return histogramBuckets(v.h)
+}
+
+// summary returns the summary without quantiles, which can not fail.
+func (v *HistogramView) summary() HistogramSummary {
+	s, _ := summarizeHistogram(v.h, nil)
+	return s
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"math"
+	"testing"
+
+	"github.com/openhistogram/circonusllhist"
+)
+
+func TestTrapMetrics_HistogramView(t *testing.T) {
+	tm, err := New(&Config{Trap: FakeTrap{}})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+
+	tags := Tags{{Category: "path", Value: "/"}}
+	for i := 1; i <= 100; i++ {
+		if err := tm.HistogramRecordValue("latency", tags, float64(i)); err != nil {
+			t.Fatalf("HistogramRecordValue() error = %v", err)
+		}
+	}
+
+	v, err := tm.HistogramView("latency", tags)
+	if err != nil {
+		t.Fatalf("HistogramView() error = %v", err)
+	}
+
+	// recording after the view is taken does not change it
+	if err := tm.HistogramRecordValue("latency", tags, 1000); err != nil {
+		t.Fatalf("HistogramRecordValue() error = %v", err)
+	}
+
+	if v.Name != "latency" {
+		t.Errorf("Name = %s, want latency", v.Name)
+	}
+	if got := v.Count(); got != 100 {
+		t.Errorf("Count() = %d, want 100", got)
+	}
+
+	approx := []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"Sum", v.Sum(), 5050},
+		{"Mean", v.Mean(), 50.5},
+		{"Min", v.Min(), 1},
+		{"Max", v.Max(), 110}, // upper edge of the [100,110) bin
+	}
+	for _, tt := range approx {
+		if math.Abs(tt.got-tt.want)/tt.want > 0.02 {
+			t.Errorf("%s() = %v, want ~%v", tt.name, tt.got, tt.want)
+		}
+	}
+
+	p99, err := v.Quantile(0.99)
+	if err != nil {
+		t.Fatalf("Quantile() error = %v", err)
+	}
+	if math.Abs(p99-99) > 1 {
+		t.Errorf("Quantile(0.99) = %v, want ~99", p99)
+	}
+
+	qs, err := v.Quantiles(0.9, 0.5)
+	if err != nil {
+		t.Fatalf("Quantiles() error = %v", err)
+	}
+	if len(qs) != 2 || math.Abs(qs[0]-90) > 1 || math.Abs(qs[1]-50) > 1 {
+		t.Errorf("Quantiles(0.9, 0.5) = %v, want ~[90 50]", qs)
+	}
+
+	if _, err := v.Quantile(1.5); err == nil {
+		t.Error("Quantile(1.5) expected error")
+	}
+
+	var count uint64
+	prev := math.Inf(-1)
+	for _, b := range v.Buckets() {
+		if b.Upper < prev {
+			t.Errorf("Buckets() not ordered by upper bound (%v after %v)", b.Upper, prev)
+		}
+		prev = b.Upper
+		count += b.Count
+	}
+	if count != 100 {
+		t.Errorf("Buckets() count = %d, want 100", count)
+	}
+
+	if _, err := tm.HistogramView("missing", tags); err == nil {
+		t.Error("HistogramView() expected error for missing histogram")
+	}
+
+	if err := tm.CumulativeHistogramRecordCountForValue("size", tags, 3, 10); err != nil {
+		t.Fatalf("CumulativeHistogramRecordCountForValue() error = %v", err)
+	}
+	cv, err := tm.CumulativeHistogramView("size", tags)
+	if err != nil {
+		t.Fatalf("CumulativeHistogramView() error = %v", err)
+	}
+	if got := cv.Count(); got != 3 {
+		t.Errorf("cumulative Count() = %d, want 3", got)
+	}
+}
+
+func TestMetric_HistogramView(t *testing.T) {
+	tests := []struct {
+		metric  *Metric
+		name    string
+		wantErr bool
+	}{
+		{name: "counter", metric: &Metric{Name: "c", Mtype: mtCounter, Samples: Samples{0: int64(1)}}, wantErr: true},
+		{name: "invalid sample", metric: &Metric{Name: "h", Mtype: mtHistogram, Samples: Samples{}}, wantErr: true},
+		{name: "empty", metric: &Metric{Name: "h", Mtype: mtHistogram, Samples: Samples{0: circonusllhist.New()}}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := tt.metric.HistogramView()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("HistogramView() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if v.Count() != 0 || v.Sum() != 0 || v.Mean() != 0 || v.Min() != 0 || v.Max() != 0 {
+				t.Errorf("empty histogram = count %d sum %v mean %v min %v max %v, want zero values", v.Count(), v.Sum(), v.Mean(), v.Min(), v.Max())
+			}
+			if _, err := v.Quantile(0.5); err == nil {
+				t.Error("Quantile() expected error for empty histogram")
+			}
+			if len(v.Buckets()) != 0 {
+				t.Errorf("Buckets() = %v, want none", v.Buckets())
+			}
+		})
+	}
+}
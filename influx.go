@@ -0,0 +1,187 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/openhistogram/circonusllhist"
+)
+
+var (
+	defaultInfluxQuantiles = []float64{0.5, 0.9, 0.95, 0.99}
+
+	influxMeasurementReplacer = strings.NewReplacer(`,`, `\,`, ` `, `\ `, "\n", `\n`)
+	influxTagReplacer         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`)
+	influxStringReplacer      = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// InfluxEncoder encodes samples in InfluxDB line protocol, one line per sample:
+//
+//	name,tag=value value=1i 1631202930123000000
+//
+// Tags are used as tag keys/values (tags without a value are skipped, keys are
+// sorted). Counters and gauges are a "value" field (integers with the i suffix,
+// unsigned integers exceeding int64 with the u suffix), text is a "value" string
+// field and histograms are summarized as count, sum, mean, min, max and quantile
+// (e.g. p99) fields. Timestamps are in nanoseconds, samples without a timestamp
+// are written without one (the server assigns the time of receipt).
+//
+// Use with WriteMetrics to render a container in line protocol.
+type InfluxEncoder struct {
+	// Quantiles to include for histograms (default: 0.5, 0.9, 0.95, 0.99)
+	Quantiles []float64
+}
+
+// AppendHeader is a no-op, line protocol has no header.
+func (InfluxEncoder) AppendHeader(dst []byte) []byte {
+	return dst
+}
+
+// AppendSample appends a sample as a line.
+func (e InfluxEncoder) AppendSample(dst []byte, s *Sample, _ bool) ([]byte, error) {
+	if s.Name == "" {
+		return dst, fmt.Errorf("invalid metric name (empty)")
+	}
+
+	start := len(dst)
+
+	dst = append(dst, influxMeasurementReplacer.Replace(s.Name)...)
+	dst = appendInfluxTags(dst, s.Tags)
+	dst = append(dst, ' ')
+
+	var err error
+	if h, ok := s.Value.(*circonusllhist.Histogram); ok {
+		dst, err = e.appendHistogramFields(dst, h)
+	} else {
+		dst, err = appendInfluxValue(dst, "value", s.Value)
+	}
+	if err != nil {
+		return dst[:start], fmt.Errorf("(%s %s): %w", s.Name, s.Tags.String(), err)
+	}
+
+	if s.Timestamp != 0 {
+		dst = append(dst, ' ')
+		dst = strconv.AppendUint(dst, s.Timestamp*1e6, 10)
+	}
+
+	return append(dst, '\n'), nil
+}
+
+// AppendFooter is a no-op, line protocol has no footer.
+func (InfluxEncoder) AppendFooter(dst []byte) []byte {
+	return dst
+}
+
+func (e InfluxEncoder) appendHistogramFields(dst []byte, h *circonusllhist.Histogram) ([]byte, error) {
+	quantiles := e.Quantiles
+	if len(quantiles) == 0 {
+		quantiles = defaultInfluxQuantiles
+	}
+
+	stats, err := summarizeHistogram(h, quantiles)
+	if err != nil {
+		return dst, err
+	}
+
+	dst = append(dst, "count="...)
+	dst = strconv.AppendUint(dst, stats.Count, 10)
+	dst = append(dst, 'i')
+	if stats.Count == 0 {
+		return dst, nil
+	}
+
+	fields := []struct {
+		name string
+		val  float64
+	}{
+		{"sum", stats.Sum},
+		{"mean", stats.Mean},
+		{"min", stats.Min},
+		{"max", stats.Max},
+	}
+	for _, f := range fields {
+		dst = append(dst, ',')
+		if dst, err = appendInfluxValue(dst, f.name, f.val); err != nil {
+			return dst, err
+		}
+	}
+	for i, q := range quantiles {
+		dst = append(dst, ',')
+		if dst, err = appendInfluxValue(dst, quantileName(q), stats.Quantiles[i]); err != nil {
+			return dst, err
+		}
+	}
+
+	return dst, nil
+}
+
+// appendInfluxTags appends the tags as a sorted tag set (,key=value...).
+func appendInfluxTags(dst []byte, tags Tags) []byte {
+	if len(tags) == 0 {
+		return dst
+	}
+
+	pairs := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, t := range tags {
+		if t.Category == "" || t.Value == "" {
+			continue
+		}
+		key := influxTagReplacer.Replace(normalizeCategory(t.Category))
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		pairs = append(pairs, key+"="+influxTagReplacer.Replace(t.Value))
+	}
+	sort.Strings(pairs)
+
+	for _, p := range pairs {
+		dst = append(dst, ',')
+		dst = append(dst, p...)
+	}
+
+	return dst
+}
+
+// appendInfluxValue appends a field (key=value) in line protocol format.
+func appendInfluxValue(dst []byte, key string, val interface{}) ([]byte, error) {
+	dst = append(dst, influxTagReplacer.Replace(key)...)
+	dst = append(dst, '=')
+
+	switch v := val.(type) {
+	case string:
+		dst = append(dst, '"')
+		dst = append(dst, influxStringReplacer.Replace(v)...)
+		return append(dst, '"'), nil
+	case float32:
+		return appendInfluxFloat(dst, float64(v))
+	case float64:
+		return appendInfluxFloat(dst, v)
+	case uint64:
+		if v > math.MaxInt64 {
+			return append(strconv.AppendUint(dst, v, 10), 'u'), nil
+		}
+	}
+
+	if d, ok := appendInteger(dst, val); ok {
+		return append(d, 'i'), nil
+	}
+
+	return dst, fmt.Errorf("unsupported value type (%T)", val)
+}
+
+func appendInfluxFloat(dst []byte, v float64) ([]byte, error) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return dst, fmt.Errorf("unsupported float value (%v)", v)
+	}
+	return strconv.AppendFloat(dst, v, 'g', -1, 64), nil
+}
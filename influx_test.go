@@ -0,0 +1,135 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openhistogram/circonusllhist"
+)
+
+func TestInfluxEncoder(t *testing.T) {
+	h := circonusllhist.New()
+	for i := 1; i <= 100; i++ {
+		_ = h.RecordValue(float64(i))
+	}
+
+	tests := []struct {
+		encoder InfluxEncoder
+		name    string
+		want    string
+		sample  Sample
+		wantErr bool
+	}{
+		{
+			name:   "counter",
+			sample: Sample{Name: "requests", Type: rtInt64, Value: int64(5), Timestamp: 1631202930123, Flush: true},
+			want:   "requests value=5i 1631202930123000000\n",
+		},
+		{
+			name:   "gauge float without timestamp",
+			sample: Sample{Name: "temp", Type: rtFloat64, Value: 21.5},
+			want:   "temp value=21.5\n",
+		},
+		{
+			name:   "gauge uint64",
+			sample: Sample{Name: "big", Type: rtUint64, Value: uint64(math.MaxUint64), Timestamp: 1},
+			want:   "big value=18446744073709551615u 1000000\n",
+		},
+		{
+			name:   "gauge uint32",
+			sample: Sample{Name: "small", Type: rtUint32, Value: uint32(7)},
+			want:   "small value=7i\n",
+		},
+		{
+			name:   "text escaped",
+			sample: Sample{Name: "status", Type: rtString, Value: `say "hi" \o/`},
+			want:   `status value="say \"hi\" \\o/"` + "\n",
+		},
+		{
+			name: "tags escaped and sorted",
+			sample: Sample{
+				Name:  "disk used",
+				Type:  rtInt32,
+				Value: 3,
+				Tags: Tags{
+					{Category: "Mount Point", Value: "/var,log"},
+					{Category: "host", Value: "a=b c"},
+					{Category: "novalue"},
+				},
+			},
+			want: `disk\ used,host=a\=b\ c,mount_point=/var\,log value=3i` + "\n",
+		},
+		{
+			name:    "histogram",
+			encoder: InfluxEncoder{Quantiles: []float64{0.99, 0.5}},
+			sample:  Sample{Name: "latency", Type: rtHistogram, Value: h, Timestamp: 1, Flush: true},
+			want:    "latency count=100i,sum=5100.45,mean=51.0045,min=1,max=110,p99=100,p50=51 1000000\n",
+		},
+		{
+			name:   "empty histogram",
+			sample: Sample{Name: "latency", Type: rtHistogram, Value: circonusllhist.New()},
+			want:   "latency count=0i\n",
+		},
+		{
+			name:    "nan",
+			sample:  Sample{Name: "temp", Type: rtFloat64, Value: math.NaN()},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.encoder.AppendSample([]byte("prev\n"), &tt.sample, true)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AppendSample() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if string(got) != "prev\n" {
+					t.Errorf("AppendSample() = %q, want dst unchanged on error", got)
+				}
+				return
+			}
+			if string(got) != "prev\n"+tt.want {
+				t.Errorf("AppendSample() = %q, want %q", got, "prev\n"+tt.want)
+			}
+		})
+	}
+}
+
+func TestTrapMetrics_WriteMetricsInflux(t *testing.T) {
+	tm, err := New(&Config{Trap: FakeTrap{}, GlobalTags: Tags{{Category: "env", Value: "dev"}}})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+
+	ts := time.UnixMilli(1631202930123)
+	_ = tm.GaugeSet("temp", Tags{{Category: "room", Value: "a"}}, 20.5, &ts)
+	_ = tm.GaugeSet("temp", Tags{{Category: "room", Value: "a"}}, 21.5, nil)
+
+	var buf bytes.Buffer
+	if err := tm.WriteMetrics(&buf, InfluxEncoder{}); err != nil {
+		t.Fatalf("WriteMetrics() error = %v", err)
+	}
+
+	got := buf.String()
+	for _, want := range []string{
+		"temp,env=dev,room=a value=20.5 1631202930123000000\n",
+		"temp,env=dev,room=a value=21.5\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("WriteMetrics() = %q, want %q", got, want)
+		}
+	}
+	if n := strings.Count(got, "\n"); n != 2 {
+		t.Errorf("WriteMetrics() lines = %d, want 2", n)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"fmt"
+
+	"github.com/openhistogram/circonusllhist"
+)
+
+// Merge moves the current metrics of other into the container, so metrics from
+// multiple containers can be sent in a single submission. Counters are summed,
+// histograms are merged bin-wise and gauge/text samples are combined by timestamp.
+// Global tags of other (which are not also global tags of the container) are added
+// to its metrics so they are preserved. Metrics are consumed from other as if
+// it had been flushed. Persistent metrics of other (cumulative histograms, and
+// counters with Config.PersistentCounters) keep their value, so only the change
+// since they were last merged is added.
+func (tm *TrapMetrics) Merge(other *TrapMetrics) error {
+	if other == nil {
+		return fmt.Errorf("invalid trap metrics (nil)")
+	}
+	if other == tm {
+		return fmt.Errorf("invalid trap metrics (self)")
+	}
+
+	var extra Tags
+	for _, t := range other.globalTags {
+		found := false
+		for _, g := range tm.globalTags {
+			if t.String() == g.String() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			extra = append(extra, t)
+		}
+	}
+
+	return tm.mergeMetrics(other.mergeSnapshot(), extra)
+}
+
+// mergeSnapshot returns the metrics of the container to be merged by Merge, with
+// persistent metrics replaced by the change since the previous Merge (unchanged
+// ones are omitted). A persistent metric which decreased (e.g. was reset) is
+// merged in full.
+func (tm *TrapMetrics) mergeSnapshot() Metrics {
+	metrics := tm.snapshotMetrics()
+
+	tm.mergedmu.Lock()
+	defer tm.mergedmu.Unlock()
+
+	for id, m := range metrics {
+		if !tm.isPersistent(m) {
+			continue
+		}
+		prev := tm.merged[id]
+		tm.merged[id] = m // snapshot holds a copy of persistent metrics
+		if prev == nil {
+			continue
+		}
+		delta, ok := metricDelta(m, prev)
+		if !ok {
+			continue
+		}
+		if delta == nil {
+			delete(metrics, id)
+			continue
+		}
+		metrics[id] = delta
+	}
+
+	return metrics
+}
+
+// metricDelta returns the change in a counter or histogram since prev, nil if it
+// is unchanged. Returns false if cur is less than prev.
+func metricDelta(cur, prev *Metric) (*Metric, bool) {
+	if len(cur.Samples) == 0 || len(prev.Samples) == 0 {
+		return nil, false
+	}
+
+	var sample interface{}
+	switch c := cur.Samples[0].(type) {
+	case int64:
+		p, ok := prev.Samples[0].(int64)
+		if !ok || c < p {
+			return nil, false
+		}
+		if c == p {
+			return nil, true
+		}
+		sample = c - p
+	case *circonusllhist.Histogram:
+		p, ok := prev.Samples[0].(*circonusllhist.Histogram)
+		if !ok {
+			return nil, false
+		}
+		h, ok := histogramDelta(c, p)
+		if !ok {
+			return nil, false
+		}
+		if h.Count() == 0 {
+			return nil, true
+		}
+		sample = h
+	default:
+		return nil, false
+	}
+
+	d := *cur
+	d.Samples = Samples{0: sample}
+	return &d, true
+}
+
+// MergeMetrics merges metrics (e.g. from DecodeJSONMetrics) into the container.
+func (tm *TrapMetrics) MergeMetrics(metrics Metrics) error {
+	return tm.mergeMetrics(metrics, nil)
+}
+
+// mergeMetrics merges copies of metrics, with tags added, into the container.
+func (tm *TrapMetrics) mergeMetrics(metrics Metrics, tags Tags) error {
+	var (
+		firstErr error
+		failed   int
+	)
+
+	for _, m := range metrics {
+		c := m.copy()
+		if len(tags) > 0 {
+			c.Tags = append(append(Tags{}, m.Tags...), tags...)
+			id, err := generateMetricID(c.Name, c.Mtype, c.Tags)
+			if err != nil {
+				return err
+			}
+			c.ID = id
+		}
+
+		if err := tm.metrics.shard(c.ID).merge(c.ID, c); err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	if firstErr != nil {
+		return fmt.Errorf("%d metric(s) not merged, first: %w", failed, firstErr)
+	}
+
+	return nil
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openhistogram/circonusllhist"
+)
+
+func TestTrapMetrics_Merge(t *testing.T) {
+	tm, err := New(&Config{Trap: FakeTrap{}, GlobalTags: Tags{{Category: "host", Value: "h1"}}})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+	plugin, err := New(&Config{GlobalTags: Tags{{Category: "host", Value: "h1"}, {Category: "plugin", Value: "p1"}}})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+
+	ts := time.Now()
+	ts2 := ts.Add(time.Second)
+	pluginTags := Tags{{Category: "plugin", Value: "p1"}}
+
+	// same metrics already in the container (with the plugin tag explicitly)
+	if err := tm.CounterIncrementByValue("counter", pluginTags, 2); err != nil {
+		t.Fatalf("TrapMetrics.CounterIncrementByValue() error = %v", err)
+	}
+	if err := tm.HistogramRecordValue("histogram", pluginTags, 1); err != nil {
+		t.Fatalf("TrapMetrics.HistogramRecordValue() error = %v", err)
+	}
+	if err := tm.GaugeSet("gauge", pluginTags, 1, &ts); err != nil {
+		t.Fatalf("TrapMetrics.GaugeSet() error = %v", err)
+	}
+
+	if err := plugin.CounterIncrementByValue("counter", nil, 3); err != nil {
+		t.Fatalf("TrapMetrics.CounterIncrementByValue() error = %v", err)
+	}
+	if err := plugin.HistogramRecordValue("histogram", nil, 2); err != nil {
+		t.Fatalf("TrapMetrics.HistogramRecordValue() error = %v", err)
+	}
+	if err := plugin.GaugeSet("gauge", nil, 2, &ts2); err != nil {
+		t.Fatalf("TrapMetrics.GaugeSet() error = %v", err)
+	}
+	if err := plugin.TextSet("text", nil, "hello", nil); err != nil {
+		t.Fatalf("TrapMetrics.TextSet() error = %v", err)
+	}
+
+	if err := tm.Merge(plugin); err != nil {
+		t.Fatalf("TrapMetrics.Merge() error = %v", err)
+	}
+
+	if m, err := tm.CounterFetch("counter", pluginTags); err != nil {
+		t.Errorf("counter: %s", err)
+	} else if m.Samples[0] != int64(5) {
+		t.Errorf("counter want 5 got %v", m.Samples[0])
+	}
+	if m, err := tm.HistogramFetch("histogram", pluginTags); err != nil {
+		t.Errorf("histogram: %s", err)
+	} else if h, ok := m.Samples[0].(*circonusllhist.Histogram); !ok || h.Count() != 2 {
+		t.Errorf("histogram count want 2 got %v", m.Samples[0])
+	}
+	if m, err := tm.GaugeFetch("gauge", pluginTags); err != nil {
+		t.Errorf("gauge: %s", err)
+	} else if len(m.Samples) != 2 {
+		t.Errorf("gauge samples want 2 got %d", len(m.Samples))
+	}
+	if _, err := tm.TextFetch("text", pluginTags); err != nil {
+		t.Errorf("text: %s", err)
+	}
+
+	// consumed from the merged container
+	if _, err := plugin.CounterFetch("counter", nil); err == nil {
+		t.Error("expected metrics to be consumed from merged container")
+	}
+
+	if err := tm.Merge(tm); err == nil {
+		t.Error("expected error merging container into itself")
+	}
+}
+
+func TestTrapMetrics_MergeMetrics(t *testing.T) {
+	tm, err := New(&Config{Trap: FakeTrap{}})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+	if err := tm.GaugeSet("gauge", nil, 1.5, nil); err != nil {
+		t.Fatalf("TrapMetrics.GaugeSet() error = %v", err)
+	}
+
+	metrics, err := DecodeJSONMetrics([]byte(`{"gauge":{"_type":"n","_ts":1000,"_value":"2.5"}}`))
+	if err != nil {
+		t.Fatalf("DecodeJSONMetrics() error = %v", err)
+	}
+	if err := tm.MergeMetrics(metrics); err != nil {
+		t.Fatalf("TrapMetrics.MergeMetrics() error = %v", err)
+	}
+
+	m, err := tm.GaugeFetch("gauge", nil)
+	if err != nil {
+		t.Fatalf("TrapMetrics.GaugeFetch() error = %v", err)
+	}
+	if m.Samples[1000] != 2.5 || m.Samples[0] != 1.5 {
+		t.Errorf("gauge samples want {0:1.5 1000:2.5} got %v", m.Samples)
+	}
+}
+
+func TestTrapMetrics_MergePersistent(t *testing.T) {
+	tm, err := New(&Config{Trap: FakeTrap{}})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+	plugin, err := New(&Config{PersistentCounters: true})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+
+	check := func(wantCounter int64, wantCount uint64) {
+		t.Helper()
+		if m, err := tm.CounterFetch("counter", nil); err != nil {
+			t.Errorf("counter: %s", err)
+		} else if m.Samples[0] != wantCounter {
+			t.Errorf("counter want %d got %v", wantCounter, m.Samples[0])
+		}
+		if m, err := tm.CumulativeHistogramFetch("histogram", nil); err != nil {
+			t.Errorf("histogram: %s", err)
+		} else if h, ok := m.Samples[0].(*circonusllhist.Histogram); !ok || h.Count() != wantCount {
+			t.Errorf("histogram count want %d got %v", wantCount, m.Samples[0])
+		}
+	}
+
+	if err := plugin.CounterIncrementByValue("counter", nil, 3); err != nil {
+		t.Fatalf("TrapMetrics.CounterIncrementByValue() error = %v", err)
+	}
+	if err := plugin.CumulativeHistogramRecordCountForValue("histogram", nil, 2, 1.5); err != nil {
+		t.Fatalf("TrapMetrics.CumulativeHistogramRecordCountForValue() error = %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := tm.Merge(plugin); err != nil {
+			t.Fatalf("TrapMetrics.Merge() error = %v", err)
+		}
+	}
+	check(3, 2)
+
+	if err := plugin.CounterIncrementByValue("counter", nil, 2); err != nil {
+		t.Fatalf("TrapMetrics.CounterIncrementByValue() error = %v", err)
+	}
+	if err := plugin.CumulativeHistogramRecordCountForValue("histogram", nil, 1, 1.5); err != nil {
+		t.Fatalf("TrapMetrics.CumulativeHistogramRecordCountForValue() error = %v", err)
+	}
+	if err := plugin.CumulativeHistogramRecordCountForValue("histogram", nil, 1, -20); err != nil {
+		t.Fatalf("TrapMetrics.CumulativeHistogramRecordCountForValue() error = %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := tm.Merge(plugin); err != nil {
+			t.Fatalf("TrapMetrics.Merge() error = %v", err)
+		}
+	}
+	check(5, 4)
+
+	if m, err := tm.CumulativeHistogramFetch("histogram", nil); err == nil {
+		want := "H[-2.0e+01]=1,H[1.5e+00]=3"
+		bins := m.Samples[0].(*circonusllhist.Histogram).DecStrings()
+		sort.Strings(bins)
+		if strings.Join(bins, ",") != want {
+			t.Errorf("histogram bins want %s got %v", want, bins)
+		}
+	}
+}
@@ -10,7 +10,9 @@ import (
 	"fmt"
 	"hash/fnv"
 	"io"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/openhistogram/circonusllhist"
@@ -66,6 +68,7 @@ type Metric struct {
 	Rtype   string // set by interface methods
 	Tags    Tags
 	ID      uint64
+	idle    uint // consecutive flushes without activity (see Config.RetainIdleIntervals)
 }
 
 func (m *Metric) String() string {
@@ -78,7 +81,59 @@ func (m *Metric) String() string {
 		m.Samples)
 }
 
+// mergeMetric merges the samples of src into dst.
+func mergeMetric(dst, src *Metric) error {
+	if dst.Mtype != src.Mtype {
+		return fmt.Errorf("(%s %s) exists with different type (%s) vs (%s)", src.Name, src.Tags.String(), src.Mtype, dst.Mtype)
+	}
+
+	switch dst.Mtype {
+	case mtCounter:
+		d, _ := dst.Samples[0].(int64)
+		s, _ := src.Samples[0].(int64)
+		dst.Samples[0] = d + s
+	case mtHistogram, mtCumulativeHistogram:
+		d, okd := dst.Samples[0].(*circonusllhist.Histogram)
+		s, oks := src.Samples[0].(*circonusllhist.Histogram)
+		if !okd || !oks {
+			return fmt.Errorf("(%s %s) invalid histogram sample", src.Name, src.Tags.String())
+		}
+		d.Merge(s)
+	default:
+		for k, v := range src.Samples {
+			if _, ok := dst.Samples[k]; !ok {
+				dst.Samples[k] = v
+			}
+		}
+	}
+
+	return nil
+}
+
+// copy returns a copy of the metric, histogram samples are deep copied.
+func (m *Metric) copy() *Metric {
+	c := *m
+	c.Samples = make(Samples, len(m.Samples))
+	for k, v := range m.Samples {
+		if h, ok := v.(*circonusllhist.Histogram); ok {
+			v = copyHistogram(h)
+		}
+		c.Samples[k] = v
+	}
+	return &c
+}
+
 func (tm *TrapMetrics) newMetric(metricName, metricType string, tags Tags) (*Metric, error) {
+	id, err := generateMetricID(metricName, metricType, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	return tm.newMetricWithID(id, metricName, metricType, tags)
+}
+
+// newMetricWithID returns a new metric for an already generated metric ID.
+func (tm *TrapMetrics) newMetricWithID(id uint64, metricName, metricType string, tags Tags) (*Metric, error) {
 	if metricName == "" {
 		return nil, fmt.Errorf("invalid metric name (empty)")
 	}
@@ -89,11 +144,6 @@ func (tm *TrapMetrics) newMetric(metricName, metricType string, tags Tags) (*Met
 		return nil, fmt.Errorf("invalid tags (%d > %d)", len(tags), maxTags)
 	}
 
-	id, err := generateMetricID(metricName, metricType, tags)
-	if err != nil {
-		return nil, err
-	}
-
 	m := &Metric{
 		ID:      id,
 		Name:    metricName,
@@ -125,111 +175,401 @@ func generateSampleKey(ts *time.Time) uint64 {
 }
 
 func (tm *TrapMetrics) writeJSONMetrics(w io.Writer) error {
-	tm.metricsmu.Lock()
-	if len(tm.metrics) == 0 {
-		tm.metricsmu.Unlock()
+	return tm.encodeMetrics(w, tm.snapshotMetrics())
+}
+
+// snapshotMetrics swaps out the current set of metrics for encoding. Metrics
+// which persist across flushes (cumulative histograms, counters with Config.PersistentCounters)
+// remain in the container, the snapshot holds a copy of them.
+func (tm *TrapMetrics) snapshotMetrics() Metrics {
+	tm.foldHandles()
+
+	metrics := tm.metrics.swap(func(old, cur Metrics) {
+		for id, m := range old {
+			if tm.isPersistent(m) {
+				cur[id] = m
+				old[id] = m.copy()
+				continue
+			}
+			if r := tm.retain(m); r != nil {
+				cur[id] = r
+			}
+		}
+	})
+
+	return metrics
+}
+
+// retain returns an empty copy of a counter or histogram to carry into the next
+// interval, or nil if retention is disabled or the metric has been idle for
+// Config.RetainIdleIntervals consecutive flushes.
+func (tm *TrapMetrics) retain(m *Metric) *Metric {
+	if tm.retainIdleIntervals == 0 {
+		return nil
+	}
+
+	var active bool
+	switch m.Mtype {
+	case mtCounter:
+		v, ok := m.Samples[0].(int64)
+		active = ok && v != 0
+	case mtHistogram, mtCumulativeHistogram:
+		h, ok := m.Samples[0].(*circonusllhist.Histogram)
+		active = ok && h.Count() > 0
+	default:
 		return nil
 	}
 
-	if _, err := w.Write([]byte("{")); err != nil {
-		return fmt.Errorf("write {: %w", err)
+	idle := uint(0)
+	if !active {
+		idle = m.idle + 1
+		if idle >= tm.retainIdleIntervals {
+			return nil
+		}
+	}
+
+	r := &Metric{
+		ID:      m.ID,
+		Name:    m.Name,
+		Tags:    m.Tags,
+		Mtype:   m.Mtype,
+		Rtype:   m.Rtype,
+		Samples: make(Samples),
+		idle:    idle,
+	}
+	if m.Mtype == mtCounter {
+		r.Samples[0] = int64(0)
+	} else {
+		r.Samples[0] = circonusllhist.New()
+	}
+
+	return r
+}
+
+// copyMetrics returns a copy of the current metrics without consuming them.
+func (tm *TrapMetrics) copyMetrics() Metrics {
+	tm.foldHandles()
+
+	metrics := make(Metrics)
+	tm.metrics.each(func(m *Metric) {
+		metrics[m.ID] = m.copy()
+	})
+
+	return metrics
+}
+
+// restoreMetrics merges a snapshot which could not be submitted back into the
+// container - counters are summed, histograms merged and gauge/text samples
+// re-inserted (samples recorded since the snapshot take precedence).
+func (tm *TrapMetrics) restoreMetrics(snapshot Metrics) {
+	for id, m := range snapshot {
+		if tm.isPersistent(m) {
+			continue // never left the container
+		}
+		if err := tm.metrics.shard(id).merge(id, m); err != nil {
+			tm.Log.Warnf("restoring metric: %s", err)
+		}
+	}
+}
+
+// isPersistent returns true if the metric retains its value across flushes,
+// cumulative histograms always do.
+func (tm *TrapMetrics) isPersistent(m *Metric) bool {
+	return m.Mtype == mtCumulativeHistogram || (tm.persistentCounters && m.Mtype == mtCounter)
+}
+
+func (tm *TrapMetrics) encodeMetrics(w io.Writer, metrics Metrics) error {
+	return tm.encodeMetricsWith(w, tm.encoder, metrics)
+}
+
+// encodeMetricsWith writes metrics to w as a single payload encoded with enc.
+func (tm *TrapMetrics) encodeMetricsWith(w io.Writer, enc Encoder, metrics Metrics) error {
+	if len(metrics) == 0 {
+		return nil
 	}
 
-	var hb bytes.Buffer
+	bp := metricBufPool.Get().(*[]byte)
+	b := enc.AppendHeader((*bp)[:0])
+	defer func() {
+		*bp = b
+		metricBufPool.Put(bp)
+	}()
 
+	var s Sample
 	flushTime := time.Now()
 	first := true
-	for _, m := range tm.metrics {
-		tags := m.Tags
-		if len(tm.globalTags) > 0 {
-			tags = append(tags, tm.globalTags...)
-		}
-		metricName := m.Name + tags.Stream()
-		if len(metricName) > maxMetricNameLen {
-			tm.Log.Warnf("metric name exceeds max len (%s)", metricName)
-			continue
+	for _, m := range metrics {
+		var n int
+		b, n = tm.encodeMetric(b, enc, first, m, flushTime, &s)
+		if n > 0 {
+			first = false
 		}
-		brokerType := m.Rtype
-		if brokerType == "" {
-			tm.Log.Warnf("unknown broker metric type: %s -> %#v", metricName, *m)
+		if len(b) >= metricBufFlushLen {
+			if _, err := w.Write(b); err != nil {
+				return fmt.Errorf("write metrics: %w", err)
+			}
+			b = b[:0]
+		}
+	}
+
+	b = enc.AppendFooter(b)
+	if _, err := w.Write(b); err != nil {
+		return fmt.Errorf("write metrics: %w", err)
+	}
+
+	return nil
+}
+
+// encodeMetric appends the sample(s) of a metric using enc, returns the number
+// of samples appended.
+// s is reused for each sample to avoid allocating.
+func (tm *TrapMetrics) encodeMetric(dst []byte, enc Encoder, first bool, m *Metric, flushTime time.Time, s *Sample) ([]byte, int) {
+	if m.Rtype == "" {
+		tm.Log.Warnf("unknown broker metric type: %s -> %#v", m.Name, *m)
+		return dst, 0
+	}
+
+	tags := m.Tags
+	if len(tm.globalTags) > 0 {
+		tags = append(tags[:len(tags):len(tags)], tm.globalTags...)
+	}
+
+	*s = Sample{
+		Name:       m.Name,
+		Tags:       tags,
+		MetricType: m.Mtype,
+		Type:       m.Rtype,
+	}
+
+	n := 0
+	add := func() {
+		b, err := enc.AppendSample(dst, s, first && n == 0)
+		if err != nil {
+			tm.Log.Warnf("encoding metric (%s %s): %s", m.Name, m.Tags, err)
+			return
+		}
+		dst = b
+		n++
+	}
+
+	switch m.Mtype {
+	case mtGauge, mtText:
+		for sampleKey, sampleValue := range m.Samples {
+			s.Timestamp = sampleKey
+			s.Value = sampleValue
+			add()
+		}
+	case mtCounter:
+		s.Timestamp = generateSampleKey(&flushTime)
+		s.Flush = true
+		s.Value = m.Samples[0]
+		add()
+	case mtCumulativeHistogram, mtHistogram:
+		s.Timestamp = generateSampleKey(&flushTime)
+		s.Flush = true
+		s.Value = m.Samples[0]
+		cfg := tm.histogramSummaryConfig(m.ID)
+		if cfg == nil || !cfg.Replace {
+			add()
+		}
+		if cfg == nil {
+			break
+		}
+		h, ok := m.Samples[0].(*circonusllhist.Histogram)
+		if !ok {
+			break
+		}
+		gauges, err := summaryGauges(h, cfg)
+		if err != nil {
+			tm.Log.Warnf("summarizing histogram (%s %s): %s", m.Name, m.Tags, err)
+			break
+		}
+		s.MetricType = mtGauge
+		for _, g := range gauges {
+			s.Tags = append(tags[:len(tags):len(tags)], Tag{Category: summaryStatCategory, Value: g.stat})
+			s.Type = g.rtype
+			s.Value = g.value
+			add()
+		}
+	}
+
+	return dst, n
+}
+
+// metricChunk is a single submission payload and the metrics it contains.
+type metricChunk struct {
+	metrics Metrics
+	buf     bytes.Buffer
+	samples int
+}
+
+// encodeMetricChunks encodes metrics into one or more payloads, each within
+// Config.MaxPayloadBytes and Config.MaxPayloadMetrics (when set). The first
+// payload is encoded into buf. A metric's samples are never split across
+// payloads, so a single metric exceeding the limits is sent on its own.
+func (tm *TrapMetrics) encodeMetricChunks(buf bytes.Buffer, metrics Metrics) ([]*metricChunk, error) {
+	if len(metrics) == 0 {
+		return nil, nil
+	}
+
+	if tm.maxPayloadBytes <= 0 && tm.maxPayloadMetrics <= 0 {
+		if err := tm.encodeMetrics(&buf, metrics); err != nil {
+			return nil, err
+		}
+		return []*metricChunk{{buf: buf, metrics: metrics, samples: len(metrics)}}, nil
+	}
+
+	var (
+		chunks  []*metricChunk
+		scratch []byte
+		s       Sample
+	)
+
+	flushTime := time.Now()
+	footer := len(tm.encoder.AppendFooter(nil))
+	chunk := &metricChunk{buf: buf, metrics: make(Metrics)}
+	chunk.buf.Write(tm.encoder.AppendHeader(nil))
+
+	for id, m := range metrics {
+		var n int
+		scratch, n = tm.encodeMetric(scratch[:0], tm.encoder, chunk.samples == 0, m, flushTime, &s)
+		if n == 0 {
 			continue
 		}
 
-		switch m.Mtype {
-		case mtGauge, mtText:
-			for sampleKey, sampleValue := range m.Samples {
-				_ = writeMetric(w, &first, metricName, brokerType, sampleValue, sampleKey)
-			}
-		case mtCounter, mtCumulativeHistogram, mtHistogram:
-			sampleKey := generateSampleKey(&flushTime)
-			if m.Mtype == mtCounter {
-				_ = writeMetric(w, &first, metricName, brokerType, m.Samples[0], sampleKey)
-			} else {
-				hb.Reset()
-				if s, ok := m.Samples[0].(*circonusllhist.Histogram); ok {
-					if err := s.SerializeB64(&hb); err != nil {
-						tm.Log.Warnf("serializing histogram (%s %s): %s", m.Name, m.Tags, err)
-						continue
-					}
-				}
-				_ = writeMetric(w, &first, metricName, brokerType, hb.String(), sampleKey)
+		if chunk.samples > 0 {
+			full := tm.maxPayloadMetrics > 0 && chunk.samples+n > tm.maxPayloadMetrics
+			full = full || (tm.maxPayloadBytes > 0 && chunk.buf.Len()+len(scratch)+footer > tm.maxPayloadBytes)
+			if full {
+				chunk.buf.Write(tm.encoder.AppendFooter(nil))
+				chunks = append(chunks, chunk)
+				chunk = &metricChunk{metrics: make(Metrics)}
+				chunk.buf.Write(tm.encoder.AppendHeader(nil))
+				// re-encode as the first metric of the new payload
+				scratch, n = tm.encodeMetric(scratch[:0], tm.encoder, true, m, flushTime, &s)
 			}
 		}
+
+		chunk.buf.Write(scratch)
+		chunk.samples += n
+		chunk.metrics[id] = m
 	}
 
-	if _, err := w.Write([]byte("}")); err != nil {
-		return fmt.Errorf("write }: %w", err)
+	if chunk.samples > 0 {
+		chunk.buf.Write(tm.encoder.AppendFooter(nil))
+		chunks = append(chunks, chunk)
 	}
 
-	tm.metrics = make(Metrics)
-	tm.metricsmu.Unlock()
+	return chunks, nil
+}
+
+// metricBufFlushLen encoded metrics are written once the buffer reaches this length.
+const metricBufFlushLen = 64 * 1024
 
-	return nil
+// metricBufPool holds buffers used to encode metrics.
+var metricBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 1024)
+		return &b
+	},
 }
 
-func writeMetric(w io.Writer, first *bool, metricName, metricType string, val interface{}, ts uint64) error {
-	value := val
+// appendMetric appends a single sample in httptrap format to dst:
+//
+//	,"name":{"_type":"t","_ts":N,"_value":V}
+//
+// Output is identical to formatting with fmt (%q for names and strings, "%d"
+// for 64bit integers, "%f" for floats and %v for other values), strconv is
+// used directly to avoid fmt's reflection and intermediate strings.
+func appendMetric(dst []byte, first *bool, metricName, metricType string, val interface{}, ts uint64) []byte {
+	if *first {
+		*first = false
+	} else {
+		dst = append(dst, ',')
+	}
+
+	dst = strconv.AppendQuote(dst, metricName)
+	dst = append(dst, `:{"_type":"`...)
+	dst = append(dst, metricType...)
+	dst = append(dst, `","_ts":`...)
+	dst = strconv.AppendUint(dst, ts, 10)
+	dst = append(dst, `,"_value":`...)
+	dst = appendValue(dst, metricType, val)
+	dst = append(dst, '}')
+
+	return dst
+}
 
+// appendValue appends a sample value formatted for the broker type.
+func appendValue(dst []byte, metricType string, val interface{}) []byte {
 	switch metricType {
 	case rtString:
 		if s, ok := val.(string); ok {
 			// NOTE: convert any 'smart' quotes, escape any embedded quotes, and add string quotes
-			value = fmt.Sprintf("%q", quoteReplacer.Replace(s))
+			return strconv.AppendQuote(dst, quoteReplacer.Replace(s))
 		}
 	case rtHistogram, rtCumulativeHistogram:
 		// NOTE: need to add the string quotes
-		value = fmt.Sprintf("%q", val)
+		switch v := val.(type) {
+		case string:
+			return strconv.AppendQuote(dst, v)
+		case []byte:
+			// base64 encoded, nothing to escape
+			dst = append(dst, '"')
+			dst = append(dst, v...)
+			return append(dst, '"')
+		}
+		return append(dst, fmt.Sprintf("%q", val)...)
 	case rtUint64, rtInt64:
-		value = fmt.Sprintf(`"%d"`, val)
+		dst = append(dst, '"')
+		if d, ok := appendInteger(dst, val); ok {
+			return append(d, '"')
+		}
+		return append(append(dst, fmt.Sprintf("%d", val)...), '"')
 	case rtFloat64:
-		value = fmt.Sprintf(`"%f"`, val)
+		switch v := val.(type) {
+		case float64:
+			dst = append(dst, '"')
+			return append(strconv.AppendFloat(dst, v, 'f', 6, 64), '"')
+		case float32:
+			dst = append(dst, '"')
+			return append(strconv.AppendFloat(dst, float64(v), 'f', 6, 32), '"')
+		}
+		return append(dst, fmt.Sprintf(`"%f"`, val)...)
 	}
 
-	// fastest way to get through this
-	// otherwise manipulating after
-	// to truncate the last comma
-	// can take several milliseconds...
-	comma := ","
-	if *first {
-		comma = ""
-		*first = false
+	if d, ok := appendInteger(dst, val); ok {
+		return d
 	}
 
-	metric := fmt.Sprintf(
-		`%s%q:{"_type":"%s","_ts":%d,"_value":%v}`,
-		comma,
-		metricName,
-		metricType,
-		ts,
-		value)
-
-	_, err := io.WriteString(w, metric)
+	return append(dst, fmt.Sprintf("%v", val)...)
+}
 
-	if err != nil {
-		return fmt.Errorf("buf write string: %w", err)
+// appendInteger appends an integer value, returns false if val is not an integer.
+func appendInteger(dst []byte, val interface{}) ([]byte, bool) {
+	switch v := val.(type) {
+	case int:
+		return strconv.AppendInt(dst, int64(v), 10), true
+	case int8:
+		return strconv.AppendInt(dst, int64(v), 10), true
+	case int16:
+		return strconv.AppendInt(dst, int64(v), 10), true
+	case int32:
+		return strconv.AppendInt(dst, int64(v), 10), true
+	case int64:
+		return strconv.AppendInt(dst, v, 10), true
+	case uint:
+		return strconv.AppendUint(dst, uint64(v), 10), true
+	case uint8:
+		return strconv.AppendUint(dst, uint64(v), 10), true
+	case uint16:
+		return strconv.AppendUint(dst, uint64(v), 10), true
+	case uint32:
+		return strconv.AppendUint(dst, uint64(v), 10), true
+	case uint64:
+		return strconv.AppendUint(dst, v, 10), true
 	}
-
-	return nil
+	return dst, false
 }
 
 func (tm *TrapMetrics) jsonMetrics() (bytes.Buffer, error) {
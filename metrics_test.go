@@ -0,0 +1,235 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/openhistogram/circonusllhist"
+)
+
+func TestTrapMetrics_RetainIdleIntervals(t *testing.T) {
+	tests := []struct {
+		name       string
+		wantJSON   []string
+		retain     uint
+		wantFlushN int
+	}{
+		{
+			name:       "disabled",
+			retain:     0,
+			wantJSON:   []string{`"_value":"1"`},
+			wantFlushN: 1,
+		},
+		{
+			name:       "two idle intervals",
+			retain:     2,
+			wantJSON:   []string{`"_value":"1"`, `"_value":"0"`, `"_value":"0"`},
+			wantFlushN: 3,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			tm, err := New(&Config{Trap: FakeTrap{}, RetainIdleIntervals: tt.retain})
+			if err != nil {
+				t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+			}
+
+			if err := tm.CounterIncrement("counter", nil); err != nil {
+				t.Fatalf("TrapMetrics.CounterIncrement() error = %v", err)
+			}
+			if err := tm.HistogramRecordValue("histogram", nil, 1); err != nil {
+				t.Fatalf("TrapMetrics.HistogramRecordValue() error = %v", err)
+			}
+
+			flushes := 0
+			for {
+				jm, err := tm.JSONMetrics()
+				if err != nil {
+					break
+				}
+				if flushes >= len(tt.wantJSON) {
+					t.Fatalf("unexpected flush %d: %s", flushes, string(jm))
+				}
+				if !strings.Contains(string(jm), tt.wantJSON[flushes]) {
+					t.Errorf("flush %d json metrics want [%v] got [%v]", flushes, tt.wantJSON[flushes], string(jm))
+				}
+				if !strings.Contains(string(jm), `"histogram"`) {
+					t.Errorf("flush %d json metrics missing histogram [%v]", flushes, string(jm))
+				}
+				flushes++
+			}
+
+			if flushes != tt.wantFlushN {
+				t.Errorf("flushes want %d got %d", tt.wantFlushN, flushes)
+			}
+		})
+	}
+}
+
+// sprintfMetric is the original fmt based sample writer, appendMetric output must be identical.
+func sprintfMetric(w io.Writer, first *bool, metricName, metricType string, val interface{}, ts uint64) {
+	value := val
+
+	switch metricType {
+	case rtString:
+		if s, ok := val.(string); ok {
+			value = fmt.Sprintf("%q", quoteReplacer.Replace(s))
+		}
+	case rtHistogram, rtCumulativeHistogram:
+		value = fmt.Sprintf("%q", val)
+	case rtUint64, rtInt64:
+		value = fmt.Sprintf(`"%d"`, val)
+	case rtFloat64:
+		value = fmt.Sprintf(`"%f"`, val)
+	}
+
+	comma := ","
+	if *first {
+		comma = ""
+		*first = false
+	}
+
+	_, _ = io.WriteString(w, fmt.Sprintf(`%s%q:{"_type":"%s","_ts":%d,"_value":%v}`, comma, metricName, metricType, ts, value))
+}
+
+func TestAppendMetric(t *testing.T) {
+	tests := []struct {
+		val        interface{}
+		name       string
+		metricName string
+		metricType string
+		want       string
+		ts         uint64
+	}{
+		{name: "int32", metricName: "foo", metricType: rtInt32, val: int32(-2), ts: 1, want: `"foo":{"_type":"i","_ts":1,"_value":-2}`},
+		{name: "int", metricName: "foo", metricType: rtInt32, val: 3, want: `"foo":{"_type":"i","_ts":0,"_value":3}`},
+		{name: "int8", metricName: "foo", metricType: rtInt32, val: int8(-8), want: `"foo":{"_type":"i","_ts":0,"_value":-8}`},
+		{name: "uint8", metricName: "foo", metricType: rtUint32, val: uint8(8), want: `"foo":{"_type":"I","_ts":0,"_value":8}`},
+		{name: "uint32", metricName: "foo", metricType: rtUint32, val: uint32(math.MaxUint32), want: `"foo":{"_type":"I","_ts":0,"_value":4294967295}`},
+		{name: "int64", metricName: "foo", metricType: rtInt64, val: int64(math.MinInt64), want: `"foo":{"_type":"l","_ts":0,"_value":"-9223372036854775808"}`},
+		{name: "uint64", metricName: "foo", metricType: rtUint64, val: uint64(math.MaxUint64), want: `"foo":{"_type":"L","_ts":0,"_value":"18446744073709551615"}`},
+		{name: "float64", metricName: "foo", metricType: rtFloat64, val: 2.4, want: `"foo":{"_type":"n","_ts":0,"_value":"2.400000"}`},
+		{name: "float32", metricName: "foo", metricType: rtFloat64, val: float32(2.4), want: `"foo":{"_type":"n","_ts":0,"_value":"2.400000"}`},
+		{name: "float large", metricName: "foo", metricType: rtFloat64, val: 1e21, want: `"foo":{"_type":"n","_ts":0,"_value":"1000000000000000000000.000000"}`},
+		{name: "float small", metricName: "foo", metricType: rtFloat64, val: 1e-7, want: `"foo":{"_type":"n","_ts":0,"_value":"0.000000"}`},
+		{name: "float neg zero", metricName: "foo", metricType: rtFloat64, val: math.Copysign(0, -1), want: `"foo":{"_type":"n","_ts":0,"_value":"-0.000000"}`},
+		{name: "float inf", metricName: "foo", metricType: rtFloat64, val: math.Inf(1), want: `"foo":{"_type":"n","_ts":0,"_value":"+Inf"}`},
+		{name: "float nan", metricName: "foo", metricType: rtFloat64, val: math.NaN(), want: `"foo":{"_type":"n","_ts":0,"_value":"NaN"}`},
+		{name: "text", metricName: "foo", metricType: rtString, val: "a \"b\" c", want: `"foo":{"_type":"s","_ts":0,"_value":"a \"b\" c"}`},
+		{name: "text smart quotes", metricName: "foo", metricType: rtString, val: "“b”", want: `"foo":{"_type":"s","_ts":0,"_value":"\"b\""}`},
+		{name: "text unicode", metricName: "foo", metricType: rtString, val: "café\t\x01", want: `"foo":{"_type":"s","_ts":0,"_value":"café\t\x01"}`},
+		{name: "histogram", metricName: "foo", metricType: rtHistogram, val: "AAEKAAAB", want: `"foo":{"_type":"h","_ts":0,"_value":"AAEKAAAB"}`},
+		{name: "stream tags", metricName: `foo|ST[b"Y2F0":b"dmFs"]`, metricType: rtInt64, val: int64(1), ts: 1631202930123, want: `"foo|ST[b\"Y2F0\":b\"dmFs\"]":{"_type":"l","_ts":1631202930123,"_value":"1"}`},
+		{name: "mismatched type", metricName: "foo", metricType: rtInt64, val: 1.5, want: `"foo":{"_type":"l","_ts":0,"_value":"%!d(float64=1.5)"}`},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			first := true
+			got := string(appendMetric(nil, &first, tt.metricName, tt.metricType, tt.val, tt.ts))
+			if got != tt.want {
+				t.Errorf("appendMetric() = %s, want %s", got, tt.want)
+			}
+
+			var ref bytes.Buffer
+			first = true
+			sprintfMetric(&ref, &first, tt.metricName, tt.metricType, tt.val, tt.ts)
+			if got != ref.String() {
+				t.Errorf("appendMetric() = %s, fmt = %s", got, ref.String())
+			}
+
+			got = string(appendMetric(nil, &first, tt.metricName, tt.metricType, tt.val, tt.ts))
+			if !strings.HasPrefix(got, ",") {
+				t.Errorf("appendMetric() = %s, want leading comma", got)
+			}
+		})
+	}
+}
+
+func TestAppendMetric_Histogram(t *testing.T) {
+	h := circonusllhist.New()
+	for i := 0; i < 100; i++ {
+		_ = h.RecordValue(float64(i) * 1.5)
+	}
+	var hb bytes.Buffer
+	if err := h.SerializeB64(&hb); err != nil {
+		t.Fatalf("SerializeB64() error = %v", err)
+	}
+
+	first := true
+	got := string(appendMetric(nil, &first, "foo", rtHistogram, hb.Bytes(), 1))
+
+	var ref bytes.Buffer
+	first = true
+	sprintfMetric(&ref, &first, "foo", rtHistogram, hb.String(), 1)
+	if got != ref.String() {
+		t.Errorf("appendMetric() = %s, fmt = %s", got, ref.String())
+	}
+}
+
+func benchmarkMetrics(n int) *TrapMetrics {
+	tm, _ := New(&Config{Trap: FakeTrap{}})
+	for i := 0; i < n; i++ {
+		tags := Tags{{Category: "host", Value: fmt.Sprintf("host%d", i%100)}, {Category: "svc", Value: "api"}}
+		name := fmt.Sprintf("metric_%d", i)
+		switch i % 4 {
+		case 0:
+			_ = tm.CounterIncrementByValue(name, tags, uint64(i))
+		case 1:
+			_ = tm.GaugeSet(name, tags, float64(i)/3, nil)
+		case 2:
+			_ = tm.GaugeSet(name, tags, i, nil)
+		case 3:
+			_ = tm.TextSet(name, tags, "some text value", nil)
+		}
+	}
+	return tm
+}
+
+func BenchmarkEncodeMetrics(b *testing.B) {
+	tm := benchmarkMetrics(10000)
+	metrics := tm.copyMetrics()
+	var buf bytes.Buffer
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		_ = tm.encodeMetrics(&buf, metrics)
+	}
+}
+
+func BenchmarkAppendMetric(b *testing.B) {
+	buf := make([]byte, 0, 256)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		first := true
+		buf = appendMetric(buf[:0], &first, `foo|ST[b"Y2F0":b"dmFs"]`, rtFloat64, 1.5, 1631202930123)
+	}
+}
+
+func BenchmarkSprintfMetric(b *testing.B) {
+	var buf bytes.Buffer
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		first := true
+		sprintfMetric(&buf, &first, `foo|ST[b"Y2F0":b"dmFs"]`, rtFloat64, 1.5, 1631202930123)
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+// Package exporter is an OpenTelemetry SDK metric exporter which records
+// metrics in a trapmetrics container and flushes them to the container's trap.
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	trapmetrics "github.com/circonus-labs/go-trapmetrics"
+	"github.com/circonus-labs/go-trapmetrics/otel/internal/buckets"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// Config defines the exporter.
+type Config struct {
+	// TrapMetrics container metrics are recorded in (required)
+	TrapMetrics *trapmetrics.TrapMetrics
+
+	// Tags is a list of tags to be added to every metric
+	Tags trapmetrics.Tags
+
+	// ResourceKeys resource attributes added to every metric as tags (e.g. service.name)
+	ResourceKeys []string
+
+	// NoFlush only record metrics on export, the container is flushed elsewhere
+	// (e.g. with TrapMetrics.Start), otherwise the container is flushed after each export
+	NoFlush bool
+}
+
+// Exporter records OpenTelemetry metrics in a trapmetrics container. Use with a
+// periodic reader, e.g. metric.NewPeriodicReader(exp).
+//
+//   - monotonic sums -> counters (int64) or gauges accumulating the delta (float64)
+//   - non-monotonic sums and gauges -> gauges
+//   - histograms and exponential histograms -> histograms, bucket counts are
+//     recorded as described in package otel/internal/buckets (shared with the receiver)
+//
+// Delta temporality is requested for counters and histograms so each export
+// records the change since the previous export. Data point attributes are mapped
+// to tags.
+type Exporter struct {
+	tm           *trapmetrics.TrapMetrics
+	tags         trapmetrics.Tags
+	resourceKeys []attribute.Key
+	mu           sync.Mutex
+	noFlush      bool
+	shutdown     bool
+}
+
+var _ metric.Exporter = (*Exporter)(nil)
+
+// New returns an exporter recording metrics in cfg.TrapMetrics.
+func New(cfg *Config) (*Exporter, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("invalid config (nil)")
+	}
+	if cfg.TrapMetrics == nil {
+		return nil, fmt.Errorf("invalid trap metrics (nil)")
+	}
+
+	e := &Exporter{
+		tm:      cfg.TrapMetrics,
+		tags:    cfg.Tags,
+		noFlush: cfg.NoFlush,
+	}
+	for _, k := range cfg.ResourceKeys {
+		e.resourceKeys = append(e.resourceKeys, attribute.Key(k))
+	}
+
+	return e, nil
+}
+
+// Temporality returns delta for counters and histograms, cumulative otherwise.
+func (e *Exporter) Temporality(kind metric.InstrumentKind) metricdata.Temporality {
+	switch kind {
+	case metric.InstrumentKindCounter, metric.InstrumentKindObservableCounter, metric.InstrumentKindHistogram:
+		return metricdata.DeltaTemporality
+	default:
+		return metricdata.CumulativeTemporality
+	}
+}
+
+// Aggregation returns the default aggregation for the instrument kind.
+func (e *Exporter) Aggregation(kind metric.InstrumentKind) metric.Aggregation {
+	return metric.DefaultAggregationSelector(kind)
+}
+
+// Export records the metrics in the container, then flushes it (unless Config.NoFlush).
+func (e *Exporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.shutdown {
+		return fmt.Errorf("exporter is shutdown")
+	}
+
+	base := append(trapmetrics.Tags{}, e.tags...)
+	base = append(base, e.resourceTags(rm.Resource)...)
+
+	var firstErr error
+	invalid := 0
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if err := e.record(base, m); err != nil {
+				invalid++
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+
+	if !e.noFlush {
+		if _, err := e.tm.Flush(ctx); err != nil {
+			return fmt.Errorf("flushing metrics: %w", err)
+		}
+	}
+
+	if firstErr != nil {
+		return fmt.Errorf("%d metric(s) not recorded, first: %w", invalid, firstErr)
+	}
+
+	return nil
+}
+
+// ForceFlush is a no-op, metrics are flushed on export.
+func (e *Exporter) ForceFlush(context.Context) error {
+	return nil
+}
+
+// Shutdown stops the exporter, subsequent exports return an error.
+func (e *Exporter) Shutdown(context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.shutdown = true
+	return nil
+}
+
+func (e *Exporter) resourceTags(res *resource.Resource) trapmetrics.Tags {
+	if res == nil || len(e.resourceKeys) == 0 {
+		return nil
+	}
+	set := res.Set()
+	tags := make(trapmetrics.Tags, 0, len(e.resourceKeys))
+	for _, k := range e.resourceKeys {
+		if v, ok := set.Value(k); ok {
+			tags = append(tags, trapmetrics.Tag{Category: string(k), Value: v.Emit()})
+		}
+	}
+	return tags
+}
+
+func (e *Exporter) record(base trapmetrics.Tags, m metricdata.Metrics) error {
+	switch data := m.Data.(type) {
+	case metricdata.Sum[int64]:
+		for _, dp := range data.DataPoints {
+			tags := attributeTags(base, dp.Attributes)
+			if data.IsMonotonic && data.Temporality == metricdata.DeltaTemporality {
+				if err := e.tm.CounterAdjustByValue(m.Name, tags, dp.Value); err != nil {
+					return fmt.Errorf("(%s): %w", m.Name, err)
+				}
+				continue
+			}
+			if err := e.tm.GaugeSet(m.Name, tags, dp.Value, nil); err != nil {
+				return fmt.Errorf("(%s): %w", m.Name, err)
+			}
+		}
+	case metricdata.Sum[float64]:
+		for _, dp := range data.DataPoints {
+			tags := attributeTags(base, dp.Attributes)
+			if data.IsMonotonic && data.Temporality == metricdata.DeltaTemporality {
+				if err := e.tm.GaugeAdd(m.Name, tags, dp.Value, nil); err != nil {
+					return fmt.Errorf("(%s): %w", m.Name, err)
+				}
+				continue
+			}
+			if err := e.tm.GaugeSet(m.Name, tags, dp.Value, nil); err != nil {
+				return fmt.Errorf("(%s): %w", m.Name, err)
+			}
+		}
+	case metricdata.Gauge[int64]:
+		for _, dp := range data.DataPoints {
+			if err := e.tm.GaugeSet(m.Name, attributeTags(base, dp.Attributes), dp.Value, nil); err != nil {
+				return fmt.Errorf("(%s): %w", m.Name, err)
+			}
+		}
+	case metricdata.Gauge[float64]:
+		for _, dp := range data.DataPoints {
+			if err := e.tm.GaugeSet(m.Name, attributeTags(base, dp.Attributes), dp.Value, nil); err != nil {
+				return fmt.Errorf("(%s): %w", m.Name, err)
+			}
+		}
+	case metricdata.Histogram[int64]:
+		for _, dp := range data.DataPoints {
+			maxVal, ok := dp.Max.Value()
+			counts := buckets.Explicit(dp.Bounds, dp.BucketCounts, float64(maxVal), ok)
+			if err := e.recordBuckets(m.Name, attributeTags(base, dp.Attributes), counts); err != nil {
+				return err
+			}
+		}
+	case metricdata.Histogram[float64]:
+		for _, dp := range data.DataPoints {
+			maxVal, ok := dp.Max.Value()
+			counts := buckets.Explicit(dp.Bounds, dp.BucketCounts, maxVal, ok)
+			if err := e.recordBuckets(m.Name, attributeTags(base, dp.Attributes), counts); err != nil {
+				return err
+			}
+		}
+	case metricdata.ExponentialHistogram[int64]:
+		for _, dp := range data.DataPoints {
+			counts := buckets.Exponential(dp.Scale, dp.ZeroCount, dp.PositiveBucket.Offset, dp.PositiveBucket.Counts, dp.NegativeBucket.Offset, dp.NegativeBucket.Counts)
+			if err := e.recordBuckets(m.Name, attributeTags(base, dp.Attributes), counts); err != nil {
+				return err
+			}
+		}
+	case metricdata.ExponentialHistogram[float64]:
+		for _, dp := range data.DataPoints {
+			counts := buckets.Exponential(dp.Scale, dp.ZeroCount, dp.PositiveBucket.Offset, dp.PositiveBucket.Counts, dp.NegativeBucket.Offset, dp.NegativeBucket.Counts)
+			if err := e.recordBuckets(m.Name, attributeTags(base, dp.Attributes), counts); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("(%s): unsupported aggregation (%T)", m.Name, m.Data)
+	}
+
+	return nil
+}
+
+// recordBuckets records bucket counts at the value of each bucket (see package buckets).
+func (e *Exporter) recordBuckets(name string, tags trapmetrics.Tags, counts []buckets.Count) error {
+	for _, b := range counts {
+		if b.Count == 0 {
+			continue
+		}
+		if err := e.tm.HistogramRecordCountForValue(name, tags, int64(b.Count), b.Value); err != nil {
+			return fmt.Errorf("(%s): %w", name, err)
+		}
+	}
+	return nil
+}
+
+// attributeTags returns base with the attributes appended as tags.
+func attributeTags(base trapmetrics.Tags, attrs attribute.Set) trapmetrics.Tags {
+	tags := make(trapmetrics.Tags, 0, len(base)+attrs.Len())
+	tags = append(tags, base...)
+	iter := attrs.Iter()
+	for iter.Next() {
+		kv := iter.Attribute()
+		tags = append(tags, trapmetrics.Tag{Category: string(kv.Key), Value: kv.Value.Emit()})
+	}
+	return tags
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package exporter
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	trapmetrics "github.com/circonus-labs/go-trapmetrics"
+	"github.com/openhistogram/circonusllhist"
+	"go.opentelemetry.io/otel/attribute"
+	otelmetric "go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+func TestExporter_Export(t *testing.T) {
+	tm, err := trapmetrics.New(&trapmetrics.Config{})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+
+	exp, err := New(&Config{TrapMetrics: tm, NoFlush: true, ResourceKeys: []string{"service.name"}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	res := resource.NewSchemaless(attribute.String("service.name", "api"), attribute.String("host.name", "h1"))
+	provider := metric.NewMeterProvider(metric.WithReader(metric.NewPeriodicReader(exp)), metric.WithResource(res))
+	defer func() { _ = provider.Shutdown(context.Background()) }()
+
+	ctx := context.Background()
+	meter := provider.Meter("test")
+	attrs := otelmetric.WithAttributes(attribute.String("method", "GET"))
+
+	requests, _ := meter.Int64Counter("requests")
+	requests.Add(ctx, 3, attrs)
+	requests.Add(ctx, 2, attrs)
+
+	inflight, _ := meter.Int64UpDownCounter("inflight")
+	inflight.Add(ctx, 5, attrs)
+	inflight.Add(ctx, -2, attrs)
+
+	temp, _ := meter.Float64Gauge("temp")
+	temp.Record(ctx, 21.5, attrs)
+
+	latency, _ := meter.Float64Histogram("latency", otelmetric.WithExplicitBucketBoundaries(1, 5, 10))
+	for _, v := range []float64{0.5, 3, 3, 7, 20} {
+		latency.Record(ctx, v, attrs)
+	}
+
+	if err := provider.ForceFlush(ctx); err != nil {
+		t.Fatalf("ForceFlush() error = %v", err)
+	}
+
+	tags := trapmetrics.Tags{{Category: "service.name", Value: "api"}, {Category: "method", Value: "GET"}}
+
+	m, err := tm.CounterFetch("requests", tags)
+	if err != nil {
+		t.Fatalf("CounterFetch() error = %v", err)
+	}
+	if v := m.Samples[0]; v != int64(5) {
+		t.Errorf("requests = %v, want 5", v)
+	}
+
+	m, err = tm.GaugeFetch("inflight", tags)
+	if err != nil {
+		t.Fatalf("GaugeFetch() error = %v", err)
+	}
+	if v := m.Samples[0]; v != int64(3) {
+		t.Errorf("inflight = %v, want 3", v)
+	}
+
+	m, err = tm.GaugeFetch("temp", tags)
+	if err != nil {
+		t.Fatalf("GaugeFetch() error = %v", err)
+	}
+	if v := m.Samples[0]; v != 21.5 {
+		t.Errorf("temp = %v, want 21.5", v)
+	}
+
+	m, err = tm.HistogramFetch("latency", tags)
+	if err != nil {
+		t.Fatalf("HistogramFetch() error = %v", err)
+	}
+	h := m.Samples[0].(*circonusllhist.Histogram)
+	if h.Count() != 5 {
+		t.Errorf("latency count = %d, want 5", h.Count())
+	}
+	// buckets recorded at upper bounds 1, 5, 5, 10 and the max 20
+	if got := h.ApproxSum(); math.Abs(got-41) > 2 {
+		t.Errorf("latency sum = %v, want ~41", got)
+	}
+
+	// delta temporality, counter only has the change since the last export
+	requests.Add(ctx, 1, attrs)
+	_, _ = tm.JSONMetrics()
+	if err := provider.ForceFlush(ctx); err != nil {
+		t.Fatalf("ForceFlush() error = %v", err)
+	}
+	m, err = tm.CounterFetch("requests", tags)
+	if err != nil {
+		t.Fatalf("CounterFetch() error = %v", err)
+	}
+	if v := m.Samples[0]; v != int64(1) {
+		t.Errorf("requests = %v, want 1", v)
+	}
+}
+
+func TestExporter_ExponentialHistogram(t *testing.T) {
+	tm, err := trapmetrics.New(&trapmetrics.Config{})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+
+	exp, err := New(&Config{TrapMetrics: tm, NoFlush: true, Tags: trapmetrics.Tags{{Category: "env", Value: "test"}}})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	// scale 0, base 2: bucket 1 is (2,4], bucket 2 is (4,8], bucket 3 is (8,16]
+	rm := &metricdata.ResourceMetrics{
+		ScopeMetrics: []metricdata.ScopeMetrics{{
+			Metrics: []metricdata.Metrics{{
+				Name: "size",
+				Data: metricdata.ExponentialHistogram[float64]{
+					Temporality: metricdata.DeltaTemporality,
+					DataPoints: []metricdata.ExponentialHistogramDataPoint[float64]{{
+						Scale:          0,
+						ZeroCount:      1,
+						PositiveBucket: metricdata.ExponentialBucket{Offset: 1, Counts: []uint64{2, 1}},
+						NegativeBucket: metricdata.ExponentialBucket{Offset: 3, Counts: []uint64{1}},
+					}},
+				},
+			}},
+		}},
+	}
+
+	if err := exp.Export(context.Background(), rm); err != nil {
+		t.Fatalf("Export() error = %v", err)
+	}
+
+	m, err := tm.HistogramFetch("size", trapmetrics.Tags{{Category: "env", Value: "test"}})
+	if err != nil {
+		t.Fatalf("HistogramFetch() error = %v", err)
+	}
+	h := m.Samples[0].(*circonusllhist.Histogram)
+	if h.Count() != 5 {
+		t.Errorf("size count = %d, want 5", h.Count())
+	}
+	want := map[string]bool{"H[0.0e+00]=1": true, "H[3.0e+00]=2": true, "H[6.0e+00]=1": true, "H[-1.2e+01]=1": true}
+	for _, bin := range h.DecStrings() {
+		if !want[bin] {
+			t.Errorf("unexpected bin %s, want %v", bin, want)
+		}
+	}
+
+	if err := exp.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	if err := exp.Export(context.Background(), rm); err == nil {
+		t.Error("Export() expected error after shutdown")
+	}
+}
+
+func TestExporter_Flush(t *testing.T) {
+	if _, err := New(&Config{}); err == nil {
+		t.Error("New() expected error for nil trap metrics")
+	}
+
+	tm, err := trapmetrics.New(&trapmetrics.Config{})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+	exp, err := New(&Config{TrapMetrics: tm})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	// flushed after export, the container has no trap configured
+	if err := exp.Export(context.Background(), &metricdata.ResourceMetrics{}); err == nil {
+		t.Error("Export() expected flush error")
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+// Package buckets maps OpenTelemetry histogram buckets to the values their
+// counts are recorded at in a trapmetrics histogram, so the exporter and the
+// receiver record the same data identically.
+//
+//   - explicit bucket histograms: each bucket's count at its upper bound, the
+//     overflow bucket at the max (or the largest bound when max is not set)
+//   - exponential histograms: each bucket's count at its midpoint, the zero
+//     bucket at 0
+package buckets
+
+import "math"
+
+// Count is the count of a bucket and the value it is recorded at.
+type Count struct {
+	Value float64
+	Count uint64
+}
+
+// Explicit returns the bucket counts of an explicit bucket histogram data point.
+func Explicit(bounds []float64, counts []uint64, maxVal float64, hasMax bool) []Count {
+	buckets := make([]Count, 0, len(counts))
+	for i, count := range counts {
+		var val float64
+		switch {
+		case i < len(bounds):
+			val = bounds[i]
+		case hasMax:
+			val = maxVal
+		case len(bounds) > 0:
+			val = bounds[len(bounds)-1]
+		}
+		buckets = append(buckets, Count{Value: val, Count: count})
+	}
+	return buckets
+}
+
+// Exponential returns the bucket counts of an exponential histogram data point,
+// the positive and negative bucket counts start at their offsets.
+func Exponential(scale int32, zeroCount uint64, posOffset int32, pos []uint64, negOffset int32, neg []uint64) []Count {
+	buckets := make([]Count, 0, 1+len(pos)+len(neg))
+	buckets = append(buckets, Count{Value: 0, Count: zeroCount})
+	for i, count := range pos {
+		buckets = append(buckets, Count{Value: ExponentialMidpoint(scale, posOffset+int32(i)), Count: count})
+	}
+	for i, count := range neg {
+		buckets = append(buckets, Count{Value: -ExponentialMidpoint(scale, negOffset+int32(i)), Count: count})
+	}
+	return buckets
+}
+
+// ExponentialMidpoint returns the midpoint of the bucket at index, which covers
+// (base^index, base^(index+1)] where base = 2^(2^-scale).
+func ExponentialMidpoint(scale, index int32) float64 {
+	factor := math.Exp2(-float64(scale))
+	lower := math.Exp2(float64(index) * factor)
+	upper := math.Exp2(float64(index+1) * factor)
+	return (lower + upper) / 2
+}
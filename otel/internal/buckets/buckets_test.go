@@ -0,0 +1,59 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package buckets
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExplicit(t *testing.T) {
+	tests := []struct {
+		name   string
+		bounds []float64
+		counts []uint64
+		want   []Count
+		maxVal float64
+		hasMax bool
+	}{
+		{
+			name:   "overflow at max",
+			bounds: []float64{1, 5},
+			counts: []uint64{1, 2, 3},
+			maxVal: 9,
+			hasMax: true,
+			want:   []Count{{Value: 1, Count: 1}, {Value: 5, Count: 2}, {Value: 9, Count: 3}},
+		},
+		{
+			name:   "overflow at largest bound",
+			bounds: []float64{1, 5},
+			counts: []uint64{1, 2, 3},
+			want:   []Count{{Value: 1, Count: 1}, {Value: 5, Count: 2}, {Value: 5, Count: 3}},
+		},
+		{
+			name:   "no bounds",
+			counts: []uint64{4},
+			want:   []Count{{Value: 0, Count: 4}},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Explicit(tt.bounds, tt.counts, tt.maxVal, tt.hasMax); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Explicit() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExponential(t *testing.T) {
+	// scale 0, base 2 - bucket 0 covers (1, 2], bucket 1 (2, 4]
+	got := Exponential(0, 1, 0, []uint64{2, 3}, 1, []uint64{4})
+	want := []Count{{Value: 0, Count: 1}, {Value: 1.5, Count: 2}, {Value: 3, Count: 3}, {Value: -3, Count: 4}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Exponential() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+// Package receiver is an OTLP/HTTP metrics receiver which records the metrics
+// of ExportMetricsServiceRequest payloads in a trapmetrics container.
+package receiver
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	trapmetrics "github.com/circonus-labs/go-trapmetrics"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	contentTypeProtobuf = "application/x-protobuf"
+	contentTypeJSON     = "application/json"
+
+	defaultMaxBodySize = 16 << 20
+	defaultStateTTL    = time.Hour
+)
+
+// Config defines the receiver.
+type Config struct {
+	// TrapMetrics container metrics are recorded in (required)
+	TrapMetrics *trapmetrics.TrapMetrics
+
+	// Tags is a list of tags to be added to every metric
+	Tags trapmetrics.Tags
+
+	// MaxBodySize maximum size of a (decompressed) request body in bytes (default 16MiB)
+	MaxBodySize int64
+
+	// StateTTL the last bucket counts of a cumulative histogram series are discarded
+	// when the series has not been received for at least this long (default 1h). A
+	// discarded series is treated as new if it is received again (all counts recorded),
+	// so it should be well above the export interval of the senders.
+	StateTTL time.Duration
+}
+
+// Receiver is an http.Handler accepting OTLP/HTTP metrics export requests
+// (POST, protobuf or JSON encoded, optionally gzip compressed), e.g. mounted
+// on /v1/metrics. Metrics are recorded in the container, which is flushed
+// elsewhere (e.g. with TrapMetrics.Start).
+//
+//   - monotonic delta sums -> counters (int) or gauges accumulating the delta (double)
+//   - other sums and gauges -> gauges, with the data point timestamp
+//   - histograms and exponential histograms -> histograms, bucket counts are
+//     recorded as described in package otel/internal/buckets (shared with the exporter)
+//
+// Only the change since the previous request is recorded for cumulative
+// histograms. Resource, scope and data point attributes are mapped to tags.
+// Summaries are not supported, their data points are rejected.
+type Receiver struct {
+	lastPrune   time.Time
+	tm          *trapmetrics.TrapMetrics
+	cumulative  map[string]*cumulativeState
+	tags        trapmetrics.Tags
+	maxBodySize int64
+	stateTTL    time.Duration
+	mu          sync.Mutex
+}
+
+var _ http.Handler = (*Receiver)(nil)
+
+// New returns a receiver recording metrics in cfg.TrapMetrics.
+func New(cfg *Config) (*Receiver, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("invalid config (nil)")
+	}
+	if cfg.TrapMetrics == nil {
+		return nil, fmt.Errorf("invalid trap metrics (nil)")
+	}
+
+	r := &Receiver{
+		tm:          cfg.TrapMetrics,
+		tags:        cfg.Tags,
+		maxBodySize: cfg.MaxBodySize,
+		stateTTL:    cfg.StateTTL,
+		cumulative:  make(map[string]*cumulativeState),
+		lastPrune:   time.Now(),
+	}
+	if r.maxBodySize <= 0 {
+		r.maxBodySize = defaultMaxBodySize
+	}
+	if r.stateTTL <= 0 {
+		r.stateTTL = defaultStateTTL
+	}
+
+	return r, nil
+}
+
+// ServeHTTP handles an OTLP/HTTP metrics export request. The response is
+// encoded as the request, with a partial success when data points were rejected.
+func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	contentType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || (contentType != contentTypeProtobuf && contentType != contentTypeJSON) {
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := r.readBody(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var export colmetricspb.ExportMetricsServiceRequest
+	if contentType == contentTypeJSON {
+		err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(body, &export)
+	} else {
+		err = proto.Unmarshal(body, &export)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("decoding request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	resp := &colmetricspb.ExportMetricsServiceResponse{}
+	if rejected, err := r.Record(&export); err != nil {
+		resp.PartialSuccess = &colmetricspb.ExportMetricsPartialSuccess{
+			RejectedDataPoints: rejected,
+			ErrorMessage:       err.Error(),
+		}
+	}
+
+	var data []byte
+	if contentType == contentTypeJSON {
+		data, err = protojson.Marshal(resp)
+	} else {
+		data, err = proto.Marshal(resp)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("encoding response: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	_, _ = w.Write(data)
+}
+
+// readBody reads the request body, decompressing gzip encoded bodies.
+func (r *Receiver) readBody(req *http.Request) ([]byte, error) {
+	var body io.Reader = req.Body
+
+	switch req.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing request: %w", err)
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		return nil, fmt.Errorf("unsupported content encoding (%s)", req.Header.Get("Content-Encoding"))
+	}
+
+	data, err := io.ReadAll(io.LimitReader(body, r.maxBodySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading request: %w", err)
+	}
+	if int64(len(data)) > r.maxBodySize {
+		return nil, fmt.Errorf("request exceeds max body size (%d)", r.maxBodySize)
+	}
+
+	return data, nil
+}
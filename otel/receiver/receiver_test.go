@@ -0,0 +1,352 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package receiver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	trapmetrics "github.com/circonus-labs/go-trapmetrics"
+	"github.com/openhistogram/circonusllhist"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func stringAttr(k, v string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: k, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}}
+}
+
+func exportRequest(metrics ...*metricspb.Metric) *colmetricspb.ExportMetricsServiceRequest {
+	return &colmetricspb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{stringAttr("service.name", "api")}},
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Scope:   &commonpb.InstrumentationScope{Name: "test", Attributes: []*commonpb.KeyValue{stringAttr("lib", "x")}},
+				Metrics: metrics,
+			}},
+		}},
+	}
+}
+
+func newReceiver(t *testing.T) (*trapmetrics.TrapMetrics, *Receiver) {
+	t.Helper()
+	tm, err := trapmetrics.New(&trapmetrics.Config{})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+	r, err := New(&Config{TrapMetrics: tm})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return tm, r
+}
+
+func TestReceiver_ServeHTTP(t *testing.T) {
+	maxVal := 20.0
+	req := exportRequest(
+		&metricspb.Metric{
+			Name: "requests",
+			Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+				IsMonotonic:            true,
+				DataPoints: []*metricspb.NumberDataPoint{{
+					Attributes: []*commonpb.KeyValue{stringAttr("method", "GET")},
+					Value:      &metricspb.NumberDataPoint_AsInt{AsInt: 5},
+				}},
+			}},
+		},
+		&metricspb.Metric{
+			Name: "temp",
+			Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{
+				DataPoints: []*metricspb.NumberDataPoint{{
+					Attributes: []*commonpb.KeyValue{stringAttr("method", "GET")},
+					Value:      &metricspb.NumberDataPoint_AsDouble{AsDouble: 21.5},
+				}},
+			}},
+		},
+		&metricspb.Metric{
+			Name: "latency",
+			Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+				DataPoints: []*metricspb.HistogramDataPoint{{
+					Attributes:     []*commonpb.KeyValue{stringAttr("method", "GET")},
+					ExplicitBounds: []float64{1, 5, 10},
+					BucketCounts:   []uint64{1, 2, 1, 1},
+					Max:            &maxVal,
+				}},
+			}},
+		},
+	)
+
+	tags := trapmetrics.Tags{
+		{Category: "service.name", Value: "api"},
+		{Category: "lib", Value: "x"},
+		{Category: "method", Value: "GET"},
+	}
+
+	protoBody, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatalf("proto.Marshal() error = %v", err)
+	}
+	var gzBody bytes.Buffer
+	zw := gzip.NewWriter(&gzBody)
+	_, _ = zw.Write(protoBody)
+	_ = zw.Close()
+	jsonBody, err := protojson.Marshal(req)
+	if err != nil {
+		t.Fatalf("protojson.Marshal() error = %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		encoding    string
+		body        []byte
+	}{
+		{"protobuf", "application/x-protobuf", "", protoBody},
+		{"protobuf gzip", "application/x-protobuf", "gzip", gzBody.Bytes()},
+		{"json", "application/json", "", jsonBody},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tm, r := newReceiver(t)
+
+			hreq := httptest.NewRequest(http.MethodPost, "/v1/metrics", bytes.NewReader(tt.body))
+			hreq.Header.Set("Content-Type", tt.contentType)
+			if tt.encoding != "" {
+				hreq.Header.Set("Content-Encoding", tt.encoding)
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, hreq)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200 (%s)", rec.Code, rec.Body.String())
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != tt.contentType {
+				t.Errorf("response content type = %s, want %s", ct, tt.contentType)
+			}
+
+			m, err := tm.CounterFetch("requests", tags)
+			if err != nil {
+				t.Fatalf("CounterFetch() error = %v", err)
+			}
+			if v := m.Samples[0]; v != int64(5) {
+				t.Errorf("requests = %v, want 5", v)
+			}
+
+			m, err = tm.GaugeFetch("temp", tags)
+			if err != nil {
+				t.Fatalf("GaugeFetch() error = %v", err)
+			}
+			if v := m.Samples[0]; v != 21.5 {
+				t.Errorf("temp = %v, want 21.5", v)
+			}
+
+			m, err = tm.HistogramFetch("latency", tags)
+			if err != nil {
+				t.Fatalf("HistogramFetch() error = %v", err)
+			}
+			h := m.Samples[0].(*circonusllhist.Histogram)
+			if h.Count() != 5 {
+				t.Errorf("latency count = %d, want 5", h.Count())
+			}
+			// buckets recorded at upper bounds 1, 5, 5, 10 and the max 20
+			if got := h.ApproxSum(); math.Abs(got-41) > 2 {
+				t.Errorf("latency sum = %v, want ~41", got)
+			}
+		})
+	}
+}
+
+func TestReceiver_ServeHTTPInvalid(t *testing.T) {
+	_, r := newReceiver(t)
+
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		encoding    string
+		body        string
+		want        int
+	}{
+		{"method", http.MethodGet, "application/x-protobuf", "", "", http.StatusMethodNotAllowed},
+		{"content type", http.MethodPost, "text/plain", "", "", http.StatusUnsupportedMediaType},
+		{"encoding", http.MethodPost, "application/x-protobuf", "br", "", http.StatusBadRequest},
+		{"gzip", http.MethodPost, "application/x-protobuf", "gzip", "not gzip", http.StatusBadRequest},
+		{"json", http.MethodPost, "application/json", "", "{invalid", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			hreq := httptest.NewRequest(tt.method, "/v1/metrics", bytes.NewBufferString(tt.body))
+			hreq.Header.Set("Content-Type", tt.contentType)
+			if tt.encoding != "" {
+				hreq.Header.Set("Content-Encoding", tt.encoding)
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, hreq)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestReceiver_PartialSuccess(t *testing.T) {
+	_, r := newReceiver(t)
+
+	req := exportRequest(&metricspb.Metric{
+		Name: "rpc",
+		Data: &metricspb.Metric_Summary{Summary: &metricspb.Summary{
+			DataPoints: []*metricspb.SummaryDataPoint{{Count: 1}, {Count: 2}},
+		}},
+	})
+	body, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatalf("proto.Marshal() error = %v", err)
+	}
+
+	hreq := httptest.NewRequest(http.MethodPost, "/v1/metrics", bytes.NewReader(body))
+	hreq.Header.Set("Content-Type", "application/x-protobuf")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, hreq)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	var resp colmetricspb.ExportMetricsServiceResponse
+	if err := proto.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("proto.Unmarshal() error = %v", err)
+	}
+	if got := resp.GetPartialSuccess().GetRejectedDataPoints(); got != 2 {
+		t.Errorf("rejected = %d, want 2", got)
+	}
+	if resp.GetPartialSuccess().GetErrorMessage() == "" {
+		t.Error("expected partial success error message")
+	}
+}
+
+func TestReceiver_CumulativeHistogram(t *testing.T) {
+	tm, r := newReceiver(t)
+
+	histogram := func(start uint64, zero uint64, counts ...uint64) *colmetricspb.ExportMetricsServiceRequest {
+		return exportRequest(&metricspb.Metric{
+			Name: "size",
+			Data: &metricspb.Metric_ExponentialHistogram{ExponentialHistogram: &metricspb.ExponentialHistogram{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				DataPoints: []*metricspb.ExponentialHistogramDataPoint{{
+					StartTimeUnixNano: start,
+					ZeroCount:         zero,
+					// scale 0, base 2: bucket 1 is (2,4], bucket 2 is (4,8]
+					Positive: &metricspb.ExponentialHistogramDataPoint_Buckets{Offset: 1, BucketCounts: counts},
+				}},
+			}},
+		})
+	}
+	tags := trapmetrics.Tags{{Category: "service.name", Value: "api"}, {Category: "lib", Value: "x"}}
+
+	tests := []struct {
+		name string
+		req  *colmetricspb.ExportMetricsServiceRequest
+		want uint64
+	}{
+		{"first", histogram(1, 1, 2, 1), 4},
+		{"delta", histogram(1, 1, 3, 2), 2},
+		{"unchanged", histogram(1, 1, 3, 2), 0},
+		{"restarted", histogram(2, 0, 1, 0), 1},
+		{"reset", histogram(2, 0, 0, 1), 1},
+	}
+
+	for _, tt := range tests {
+		if _, err := r.Record(tt.req); err != nil {
+			t.Fatalf("%s: Record() error = %v", tt.name, err)
+		}
+		var got uint64
+		if m, err := tm.HistogramFetch("size", tags); err == nil {
+			got = m.Samples[0].(*circonusllhist.Histogram).Count()
+		}
+		if got != tt.want {
+			t.Errorf("%s: count = %d, want %d", tt.name, got, tt.want)
+		}
+		_, _ = tm.JSONMetrics()
+	}
+}
+
+func TestReceiver_CumulativeStateTTL(t *testing.T) {
+	tm, err := trapmetrics.New(&trapmetrics.Config{})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+	r, err := New(&Config{TrapMetrics: tm, StateTTL: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	for _, name := range []string{"a", "b"} {
+		time.Sleep(20 * time.Millisecond)
+		req := exportRequest(&metricspb.Metric{
+			Name: name,
+			Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				DataPoints:             []*metricspb.HistogramDataPoint{{StartTimeUnixNano: 1, ExplicitBounds: []float64{1}, BucketCounts: []uint64{1, 0}}},
+			}},
+		})
+		if _, err := r.Record(req); err != nil {
+			t.Fatalf("Record() error = %v", err)
+		}
+	}
+
+	// a was not received within the TTL before b was recorded
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.cumulative) != 1 {
+		t.Fatalf("cumulative state = %d series, want 1", len(r.cumulative))
+	}
+	for key := range r.cumulative {
+		if !strings.HasPrefix(key, "b|") {
+			t.Errorf("cumulative state has %s, want b", key)
+		}
+	}
+}
+
+func TestAnyValueString(t *testing.T) {
+	tests := []struct {
+		val  *commonpb.AnyValue
+		want string
+	}{
+		{&commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "a"}}, "a"},
+		{&commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: true}}, "true"},
+		{&commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: -3}}, "-3"},
+		{&commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: 1.5}}, "1.5"},
+		{&commonpb.AnyValue{Value: &commonpb.AnyValue_BytesValue{BytesValue: []byte("hi")}}, "aGk="},
+		{&commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: &commonpb.ArrayValue{
+			Values: []*commonpb.AnyValue{{Value: &commonpb.AnyValue_IntValue{IntValue: 1}}, {Value: &commonpb.AnyValue_StringValue{StringValue: "b"}}},
+		}}}, "[1,b]"},
+		{&commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{
+			Values: []*commonpb.KeyValue{stringAttr("k", "v")},
+		}}}, "{k=v}"},
+		{nil, ""},
+	}
+
+	for _, tt := range tests {
+		if got := anyValueString(tt.val); got != tt.want {
+			t.Errorf("anyValueString() = %q, want %q", got, tt.want)
+		}
+	}
+}
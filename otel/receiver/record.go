@@ -0,0 +1,238 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package receiver
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	trapmetrics "github.com/circonus-labs/go-trapmetrics"
+	"github.com/circonus-labs/go-trapmetrics/otel/internal/buckets"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+// cumulativeState is the last bucket counts received for a cumulative histogram.
+type cumulativeState struct {
+	seen   time.Time
+	counts map[float64]uint64
+	start  uint64
+}
+
+// Record records the metrics of an export request in the container. Returns
+// the number of rejected data points and an error if any were rejected.
+func (r *Receiver) Record(req *colmetricspb.ExportMetricsServiceRequest) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pruneCumulative(time.Now())
+
+	var firstErr error
+	var rejected int64
+	for _, rm := range req.GetResourceMetrics() {
+		resTags := appendAttributeTags(append(trapmetrics.Tags{}, r.tags...), rm.GetResource().GetAttributes())
+		for _, sm := range rm.GetScopeMetrics() {
+			scopeTags := appendAttributeTags(resTags[:len(resTags):len(resTags)], sm.GetScope().GetAttributes())
+			for _, m := range sm.GetMetrics() {
+				n, err := r.record(scopeTags, m)
+				rejected += n
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+
+	if firstErr != nil {
+		return rejected, fmt.Errorf("%d data point(s) not recorded, first: %w", rejected, firstErr)
+	}
+
+	return 0, nil
+}
+
+// record records the data points of a metric, returns the number of rejected
+// data points and the first error.
+func (r *Receiver) record(base trapmetrics.Tags, m *metricspb.Metric) (int64, error) {
+	name := m.GetName()
+
+	var firstErr error
+	var rejected int64
+	fail := func(err error) {
+		if err == nil {
+			return
+		}
+		rejected++
+		if firstErr == nil {
+			firstErr = fmt.Errorf("(%s): %w", name, err)
+		}
+	}
+
+	switch data := m.GetData().(type) {
+	case *metricspb.Metric_Sum:
+		delta := data.Sum.GetAggregationTemporality() == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+		for _, dp := range data.Sum.GetDataPoints() {
+			fail(r.recordNumber(name, attributeTags(base, dp.GetAttributes()), dp, delta && data.Sum.GetIsMonotonic()))
+		}
+	case *metricspb.Metric_Gauge:
+		for _, dp := range data.Gauge.GetDataPoints() {
+			fail(r.recordNumber(name, attributeTags(base, dp.GetAttributes()), dp, false))
+		}
+	case *metricspb.Metric_Histogram:
+		cumulative := data.Histogram.GetAggregationTemporality() == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+		for _, dp := range data.Histogram.GetDataPoints() {
+			fail(r.recordHistogram(name, attributeTags(base, dp.GetAttributes()), dp.GetStartTimeUnixNano(), cumulative, buckets.Explicit(dp.GetExplicitBounds(), dp.GetBucketCounts(), dp.GetMax(), dp.Max != nil)))
+		}
+	case *metricspb.Metric_ExponentialHistogram:
+		cumulative := data.ExponentialHistogram.GetAggregationTemporality() == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+		for _, dp := range data.ExponentialHistogram.GetDataPoints() {
+			pos, neg := dp.GetPositive(), dp.GetNegative()
+			counts := buckets.Exponential(dp.GetScale(), dp.GetZeroCount(), pos.GetOffset(), pos.GetBucketCounts(), neg.GetOffset(), neg.GetBucketCounts())
+			fail(r.recordHistogram(name, attributeTags(base, dp.GetAttributes()), dp.GetStartTimeUnixNano(), cumulative, counts))
+		}
+	case *metricspb.Metric_Summary:
+		for range data.Summary.GetDataPoints() {
+			fail(fmt.Errorf("unsupported metric type (summary)"))
+		}
+	}
+
+	return rejected, firstErr
+}
+
+// recordNumber records a sum or gauge data point, as a counter (or a gauge
+// accumulating the delta for doubles) when counter is true.
+func (r *Receiver) recordNumber(name string, tags trapmetrics.Tags, dp *metricspb.NumberDataPoint, counter bool) error {
+	switch v := dp.GetValue().(type) {
+	case *metricspb.NumberDataPoint_AsInt:
+		if counter {
+			return r.tm.CounterAdjustByValue(name, tags, v.AsInt)
+		}
+		return r.tm.GaugeSet(name, tags, v.AsInt, timestamp(dp.GetTimeUnixNano()))
+	case *metricspb.NumberDataPoint_AsDouble:
+		if counter {
+			return r.tm.GaugeAdd(name, tags, v.AsDouble, nil)
+		}
+		return r.tm.GaugeSet(name, tags, v.AsDouble, timestamp(dp.GetTimeUnixNano()))
+	default:
+		return fmt.Errorf("invalid data point (no value)")
+	}
+}
+
+// recordHistogram records bucket counts, only the change since the previous
+// data point is recorded for cumulative histograms.
+func (r *Receiver) recordHistogram(name string, tags trapmetrics.Tags, start uint64, cumulative bool, counts []buckets.Count) error {
+	if cumulative {
+		counts = r.cumulativeDelta(name+"|"+tags.String(), start, counts)
+	}
+
+	for _, b := range counts {
+		if b.Count == 0 {
+			continue
+		}
+		if err := r.tm.HistogramRecordCountForValue(name, tags, int64(b.Count), b.Value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pruneCumulative discards the state of cumulative histogram series not received
+// within the state TTL, checked at most once per TTL.
+func (r *Receiver) pruneCumulative(now time.Time) {
+	if now.Sub(r.lastPrune) < r.stateTTL {
+		return
+	}
+	r.lastPrune = now
+
+	for key, st := range r.cumulative {
+		if now.Sub(st.seen) >= r.stateTTL {
+			delete(r.cumulative, key)
+		}
+	}
+}
+
+// cumulativeDelta returns the change in bucket counts since the previous data
+// point for the series identified by key. All counts are returned for the first
+// data point and when the series restarted (new start time or a count decreased).
+func (r *Receiver) cumulativeDelta(key string, start uint64, counts []buckets.Count) []buckets.Count {
+	totals := make(map[float64]uint64, len(counts))
+	for _, b := range counts {
+		totals[b.Value] += b.Count
+	}
+
+	prev, ok := r.cumulative[key]
+	r.cumulative[key] = &cumulativeState{seen: time.Now(), start: start, counts: totals}
+	if !ok || prev.start != start {
+		return counts
+	}
+
+	delta := make([]buckets.Count, 0, len(totals))
+	for val, count := range totals {
+		last := prev.counts[val]
+		if count < last {
+			return counts
+		}
+		delta = append(delta, buckets.Count{Value: val, Count: count - last})
+	}
+
+	return delta
+}
+
+func timestamp(ns uint64) *time.Time {
+	if ns == 0 {
+		return nil
+	}
+	ts := time.Unix(0, int64(ns))
+	return &ts
+}
+
+// attributeTags returns base with the attributes appended as tags.
+func attributeTags(base trapmetrics.Tags, attrs []*commonpb.KeyValue) trapmetrics.Tags {
+	tags := make(trapmetrics.Tags, 0, len(base)+len(attrs))
+	tags = append(tags, base...)
+	return appendAttributeTags(tags, attrs)
+}
+
+func appendAttributeTags(tags trapmetrics.Tags, attrs []*commonpb.KeyValue) trapmetrics.Tags {
+	for _, kv := range attrs {
+		tags = append(tags, trapmetrics.Tag{Category: kv.GetKey(), Value: anyValueString(kv.GetValue())})
+	}
+	return tags
+}
+
+// anyValueString returns the string representation of an attribute value.
+func anyValueString(v *commonpb.AnyValue) string {
+	switch val := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return val.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return strconv.FormatBool(val.BoolValue)
+	case *commonpb.AnyValue_IntValue:
+		return strconv.FormatInt(val.IntValue, 10)
+	case *commonpb.AnyValue_DoubleValue:
+		return strconv.FormatFloat(val.DoubleValue, 'g', -1, 64)
+	case *commonpb.AnyValue_BytesValue:
+		return base64.StdEncoding.EncodeToString(val.BytesValue)
+	case *commonpb.AnyValue_ArrayValue:
+		list := make([]string, 0, len(val.ArrayValue.GetValues()))
+		for _, item := range val.ArrayValue.GetValues() {
+			list = append(list, anyValueString(item))
+		}
+		return "[" + strings.Join(list, ",") + "]"
+	case *commonpb.AnyValue_KvlistValue:
+		list := make([]string, 0, len(val.KvlistValue.GetValues()))
+		for _, kv := range val.KvlistValue.GetValues() {
+			list = append(list, kv.GetKey()+"="+anyValueString(kv.GetValue()))
+		}
+		return "{" + strings.Join(list, ",") + "}"
+	default:
+		return ""
+	}
+}
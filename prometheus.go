@@ -0,0 +1,281 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/openhistogram/circonusllhist"
+)
+
+const (
+	promContentType = "text/plain; version=0.0.4; charset=utf-8"
+	promTypeCounter = "counter"
+	promTypeGauge   = "gauge"
+	promTypeHist    = "histogram"
+)
+
+var promLabelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// PrometheusHandler returns an http.Handler rendering the current metrics in the
+// Prometheus text exposition format. Metrics are not consumed, they are still
+// sent on the next flush.
+func (tm *TrapMetrics) PrometheusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", promContentType)
+		if err := tm.WritePrometheus(w); err != nil {
+			tm.Log.Warnf("writing prometheus metrics: %s", err)
+		}
+	})
+}
+
+// WritePrometheus writes the current metrics to w in the Prometheus text exposition
+// format, without consuming them. Counters and gauges are written as-is (the latest
+// sample for gauges), text as an info style gauge with the text in a "value" label,
+// and histograms as Prometheus histograms with an "le" bucket for each histogram bin.
+// Counters reset every flush, so they are exposed as gauges (the count for the current
+// interval) unless Config.PersistentCounters is set, then they are monotonic and
+// exposed as Prometheus counters. Tags (including global tags) are used as labels.
+func (tm *TrapMetrics) WritePrometheus(w io.Writer) error {
+	metrics := tm.copyMetrics()
+
+	list := make([]*Metric, 0, len(metrics))
+	for _, m := range metrics {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Mtype < list[j].Mtype
+	})
+
+	type family struct {
+		mtype string
+		ptype string
+		lines []string
+	}
+	families := make(map[string]*family)
+	names := make([]string, 0)
+
+	for _, m := range list {
+		name, ptype, lines := tm.promMetric(m)
+		if len(lines) == 0 {
+			continue
+		}
+		f, ok := families[name]
+		if !ok {
+			f = &family{mtype: m.Mtype, ptype: ptype}
+			families[name] = f
+			names = append(names, name)
+		}
+		if f.mtype != m.Mtype {
+			tm.Log.Warnf("prometheus metric (%s %s) exists with different type (%s) vs (%s)", m.Name, m.Tags.String(), f.mtype, m.Mtype)
+			continue
+		}
+		f.lines = append(f.lines, lines...)
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		f := families[name]
+		if _, err := fmt.Fprintf(bw, "# TYPE %s %s\n", name, f.ptype); err != nil {
+			return fmt.Errorf("write type: %w", err)
+		}
+		for _, line := range f.lines {
+			if _, err := bw.WriteString(line); err != nil {
+				return fmt.Errorf("write metric: %w", err)
+			}
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+
+	return nil
+}
+
+// promMetric returns the family name, type and exposition lines for a metric.
+func (tm *TrapMetrics) promMetric(m *Metric) (string, string, []string) {
+	name := promName(m.Name)
+	tags := m.Tags
+	if len(tm.globalTags) > 0 {
+		tags = append(tags[:len(tags):len(tags)], tm.globalTags...)
+	}
+	labels := promLabels(tags)
+
+	switch m.Mtype {
+	case mtCounter:
+		v, ok := toFloat64(m.Samples[0])
+		if !ok {
+			return "", "", nil
+		}
+		ptype := promTypeGauge
+		if tm.persistentCounters {
+			ptype = promTypeCounter
+		}
+		return name, ptype, []string{promLine(name, labels, "", v)}
+	case mtGauge:
+		v, ok := toFloat64(latestSample(m.Samples))
+		if !ok {
+			return "", "", nil
+		}
+		return name, promTypeGauge, []string{promLine(name, labels, "", v)}
+	case mtText:
+		s, ok := latestSample(m.Samples).(string)
+		if !ok {
+			return "", "", nil
+		}
+		name += "_info"
+		return name, promTypeGauge, []string{promLine(name, labels, `value="`+promLabelValueReplacer.Replace(s)+`"`, 1)}
+	case mtHistogram, mtCumulativeHistogram:
+		h, ok := m.Samples[0].(*circonusllhist.Histogram)
+		if !ok {
+			return "", "", nil
+		}
+		buckets := histogramBuckets(h)
+		lines := make([]string, 0, len(buckets)+3)
+		var cum uint64
+		for _, b := range buckets {
+			cum += b.Count
+			lines = append(lines, promLine(name+"_bucket", labels, `le="`+promFloat(b.Upper)+`"`, float64(cum)))
+		}
+		lines = append(lines,
+			promLine(name+"_bucket", labels, `le="+Inf"`, float64(cum)),
+			promLine(name+"_sum", labels, "", h.ApproxSum()),
+			promLine(name+"_count", labels, "", float64(cum)))
+		return name, promTypeHist, lines
+	}
+
+	return "", "", nil
+}
+
+func promLine(name, labels, extra string, val float64) string {
+	var sb strings.Builder
+	sb.WriteString(name)
+	if labels != "" || extra != "" {
+		sb.WriteString("{")
+		sb.WriteString(labels)
+		if labels != "" && extra != "" {
+			sb.WriteString(",")
+		}
+		sb.WriteString(extra)
+		sb.WriteString("}")
+	}
+	sb.WriteString(" ")
+	sb.WriteString(promFloat(val))
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+func promLabels(tags Tags) string {
+	labels := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, t := range tags {
+		if t.Category == "" {
+			continue
+		}
+		name := promName(normalizeCategory(t.Category))
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		labels = append(labels, name+`="`+promLabelValueReplacer.Replace(t.Value)+`"`)
+	}
+	sort.Strings(labels)
+	return strings.Join(labels, ",")
+}
+
+// promName replaces characters which are not valid in a Prometheus metric or label name.
+func promName(name string) string {
+	var sb strings.Builder
+	sb.Grow(len(name))
+	for i, r := range name {
+		switch {
+		case r == '_' || r == ':' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z'):
+			sb.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				sb.WriteRune('_')
+			}
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune('_')
+		}
+	}
+	return sb.String()
+}
+
+func promFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// latestSample returns the sample with the most recent timestamp, samples
+// without a timestamp (key 0) are stamped at flush time so they are the latest.
+func latestSample(samples Samples) interface{} {
+	var (
+		latest interface{}
+		key    uint64
+		found  bool
+	)
+	for k, v := range samples {
+		if k == 0 {
+			return v
+		}
+		if !found || k > key {
+			latest, key, found = v, k, true
+		}
+	}
+	return latest
+}
+
+// toFloat64 converts a numeric sample value to a float64.
+func toFloat64(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
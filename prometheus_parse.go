@@ -0,0 +1,388 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// promSample is a single parsed sample line.
+type promSample struct {
+	ts     *time.Time
+	name   string
+	labels Tags
+	value  float64
+}
+
+// promHistogramStateTTL cumulative bucket counts of a histogram series not
+// ingested for this long are discarded.
+const promHistogramStateTTL = time.Hour
+
+// promHistogram collects the cumulative buckets of a histogram series.
+type promHistogram struct {
+	buckets    map[float64]float64
+	name       string
+	tags       Tags
+	cumulative bool // counts accumulate across scrapes (histogram, not gaugehistogram)
+}
+
+// promHistogramState is the last cumulative bucket counts ingested for a histogram series.
+type promHistogramState struct {
+	seen    time.Time
+	buckets map[float64]float64
+}
+
+// IngestPrometheus parses metrics in the Prometheus (or OpenMetrics) text exposition
+// format from r and records them in the container. Labels are mapped to tags, tags
+// are added to every metric (e.g. to identify the scraped target).
+//
+//   - counters with integral values are recorded as counters set to the scraped
+//     total, otherwise they are recorded as gauges
+//   - gauges, summary quantiles/sum/count and untyped samples are recorded as gauges
+//   - histogram buckets are converted from cumulative counts and recorded with
+//     HistogramRecordCountForValue at each bucket's upper bound ("le"), only the
+//     change since the series was last ingested is recorded (like counters are set
+//     to the scraped total, ingesting the same scrape twice does not double count),
+//     all counts are recorded for a new series or one which has been reset
+//
+// Malformed lines are skipped, an error is returned after the remaining input
+// has been processed.
+func (tm *TrapMetrics) IngestPrometheus(r io.Reader, tags Tags) error {
+	types := make(map[string]string)
+	histograms := make(map[string]*promHistogram)
+	order := make([]string, 0)
+
+	var (
+		firstErr error
+		invalid  int
+	)
+	fail := func(lineNum int, err error) {
+		invalid++
+		if firstErr == nil {
+			firstErr = fmt.Errorf("line %d: %w", lineNum, err)
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line)
+			if len(fields) >= 4 && fields[1] == "TYPE" {
+				types[fields[2]] = strings.ToLower(fields[3])
+			}
+			continue
+		}
+
+		s, err := parsePromSample(line)
+		if err != nil {
+			fail(lineNum, err)
+			continue
+		}
+
+		family, ptype := promFamily(types, s.name)
+		if math.IsNaN(s.value) {
+			continue
+		}
+		metricTags := append(append(Tags{}, s.labels...), tags...)
+
+		switch ptype {
+		case "histogram", "gaugehistogram":
+			switch {
+			case strings.HasSuffix(s.name, "_bucket"):
+				le, ok := takeTag(&metricTags, "le")
+				if !ok {
+					fail(lineNum, fmt.Errorf("histogram bucket without le label (%s)", s.name))
+					continue
+				}
+				bound, err := parsePromFloat(le)
+				if err != nil {
+					fail(lineNum, fmt.Errorf("invalid le label (%s): %w", le, err))
+					continue
+				}
+				key := family + "|" + metricTags.String()
+				h, ok := histograms[key]
+				if !ok {
+					h = &promHistogram{name: family, tags: metricTags, buckets: make(map[float64]float64), cumulative: ptype == "histogram"}
+					histograms[key] = h
+					order = append(order, key)
+				}
+				h.buckets[bound] = s.value
+			default:
+				// _sum, _count, _created are derived from the histogram
+			}
+		case "counter":
+			if strings.HasSuffix(s.name, "_created") {
+				continue
+			}
+			if s.value == math.Trunc(s.value) && math.Abs(s.value) < math.MaxInt64 {
+				err = tm.counterSet(s.name, metricTags, int64(s.value))
+			} else {
+				err = tm.GaugeSet(s.name, metricTags, s.value, s.ts)
+			}
+		default:
+			if strings.HasSuffix(s.name, "_created") {
+				continue
+			}
+			err = tm.GaugeSet(s.name, metricTags, s.value, s.ts)
+		}
+		if err != nil {
+			fail(lineNum, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading prometheus metrics: %w", err)
+	}
+
+	for _, key := range order {
+		h := histograms[key]
+		if h.cumulative {
+			h.buckets = tm.promHistogramDelta(key, h.buckets)
+		}
+		if err := tm.recordPromHistogram(h); err != nil {
+			fail(lineNum, err)
+		}
+	}
+
+	if firstErr != nil {
+		return fmt.Errorf("%d invalid prometheus sample(s), first: %w", invalid, firstErr)
+	}
+
+	return nil
+}
+
+// recordPromHistogram converts cumulative bucket counts to per bucket counts.
+func (tm *TrapMetrics) recordPromHistogram(h *promHistogram) error {
+	bounds := make([]float64, 0, len(h.buckets))
+	for b := range h.buckets {
+		bounds = append(bounds, b)
+	}
+	sort.Float64s(bounds)
+
+	prevCount := 0.0
+	prevBound := 0.0
+	for _, b := range bounds {
+		cum := h.buckets[b]
+		count := int64(cum - prevCount)
+		prevCount = cum
+
+		val := b
+		if math.IsInf(b, 1) {
+			val = prevBound // +Inf bucket, best estimate is the largest finite bound
+		}
+		prevBound = b
+
+		if count <= 0 {
+			continue
+		}
+		if err := tm.HistogramRecordCountForValue(h.name, h.tags, count, val); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// promHistogramDelta returns the change in cumulative bucket counts since the
+// series was last ingested, all counts for a new series or if any bucket count
+// decreased (the scraped target restarted). Series not ingested within
+// promHistogramStateTTL are discarded.
+func (tm *TrapMetrics) promHistogramDelta(key string, buckets map[float64]float64) map[float64]float64 {
+	tm.promHistogramsmu.Lock()
+	defer tm.promHistogramsmu.Unlock()
+
+	now := time.Now()
+	for k, st := range tm.promHistograms {
+		if now.Sub(st.seen) > promHistogramStateTTL {
+			delete(tm.promHistograms, k)
+		}
+	}
+
+	prev, ok := tm.promHistograms[key]
+	tm.promHistograms[key] = &promHistogramState{seen: now, buckets: buckets}
+	if !ok {
+		return buckets
+	}
+
+	delta := make(map[float64]float64, len(buckets))
+	for b, cum := range buckets {
+		last := prev.buckets[b]
+		if cum < last {
+			return buckets
+		}
+		delta[b] = cum - last
+	}
+
+	return delta
+}
+
+// promFamily returns the metric family name and type for a sample name.
+func promFamily(types map[string]string, name string) (string, string) {
+	if t, ok := types[name]; ok {
+		return name, t
+	}
+	for _, suffix := range []string{"_total", "_bucket", "_sum", "_count", "_created", "_gsum", "_gcount"} {
+		if strings.HasSuffix(name, suffix) {
+			family := strings.TrimSuffix(name, suffix)
+			if t, ok := types[family]; ok {
+				return family, t
+			}
+		}
+	}
+	return name, "untyped"
+}
+
+// parsePromSample parses a sample line: name{label="value",...} value [timestamp] [# exemplar].
+func parsePromSample(line string) (*promSample, error) {
+	s := &promSample{}
+
+	i := strings.IndexAny(line, "{ \t")
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid sample (%s)", line)
+	}
+	s.name = line[:i]
+	rest := line[i:]
+
+	if rest[0] == '{' {
+		labels, n, err := parsePromLabels(rest)
+		if err != nil {
+			return nil, err
+		}
+		s.labels = labels
+		rest = rest[n:]
+	}
+
+	// drop any OpenMetrics exemplar
+	if j := strings.Index(rest, " # "); j >= 0 {
+		rest = rest[:j]
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid sample value (%s)", line)
+	}
+
+	v, err := parsePromFloat(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid sample value (%s): %w", line, err)
+	}
+	s.value = v
+
+	if len(fields) == 2 {
+		ts, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sample timestamp (%s): %w", line, err)
+		}
+		// prometheus timestamps are in milliseconds, openmetrics in (fractional) seconds
+		var t time.Time
+		if ts > 1e11 {
+			t = time.UnixMilli(int64(ts))
+		} else {
+			t = time.Unix(0, int64(ts*float64(time.Second)))
+		}
+		s.ts = &t
+	}
+
+	return s, nil
+}
+
+// parsePromLabels parses a label set starting at '{', returns the labels and
+// the number of bytes consumed.
+func parsePromLabels(in string) (Tags, int, error) {
+	var labels Tags
+
+	i := 1
+	for {
+		for i < len(in) && (in[i] == ' ' || in[i] == ',') {
+			i++
+		}
+		if i >= len(in) {
+			return nil, 0, fmt.Errorf("unterminated label set (%s)", in)
+		}
+		if in[i] == '}' {
+			return labels, i + 1, nil
+		}
+
+		eq := strings.IndexByte(in[i:], '=')
+		if eq < 0 {
+			return nil, 0, fmt.Errorf("invalid label (%s)", in[i:])
+		}
+		name := strings.TrimSpace(in[i : i+eq])
+		i += eq + 1
+		if i >= len(in) || in[i] != '"' {
+			return nil, 0, fmt.Errorf("invalid label value (%s)", in[i:])
+		}
+		i++
+
+		var val strings.Builder
+		for {
+			if i >= len(in) {
+				return nil, 0, fmt.Errorf("unterminated label value (%s)", in)
+			}
+			c := in[i]
+			if c == '"' {
+				i++
+				break
+			}
+			if c == '\\' && i+1 < len(in) {
+				i++
+				switch in[i] {
+				case 'n':
+					val.WriteByte('\n')
+				default:
+					val.WriteByte(in[i])
+				}
+				i++
+				continue
+			}
+			val.WriteByte(c)
+			i++
+		}
+
+		labels = append(labels, Tag{Category: name, Value: val.String()})
+	}
+}
+
+func parsePromFloat(s string) (float64, error) {
+	switch s {
+	case "+Inf", "Inf":
+		return math.Inf(1), nil
+	case "-Inf":
+		return math.Inf(-1), nil
+	case "NaN":
+		return math.NaN(), nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse float: %w", err)
+	}
+	return v, nil
+}
+
+// takeTag removes the tag with the given category, returning its value.
+func takeTag(tags *Tags, category string) (string, bool) {
+	for i, t := range *tags {
+		if t.Category == category {
+			*tags = append((*tags)[:i], (*tags)[i+1:]...)
+			return t.Value, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/openhistogram/circonusllhist"
+)
+
+func TestTrapMetrics_IngestPrometheus(t *testing.T) {
+	input := `# HELP http_requests_total The total number of HTTP requests.
+# TYPE http_requests_total counter
+http_requests_total{method="post",code="200"} 1027 1395066363000
+http_requests_total{method="post",code="400"}    3 1395066363000
+
+# TYPE process_cpu_seconds_total counter
+process_cpu_seconds_total 12.5
+
+# TYPE temperature gauge
+temperature{room="a \"b\", c"} 21.5
+
+# A histogram, which has a pretty complex representation in the text format:
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{le="0.05"} 24054
+http_request_duration_seconds_bucket{le="0.1"} 33444
+http_request_duration_seconds_bucket{le="0.2"} 100392
+http_request_duration_seconds_bucket{le="+Inf"} 144320
+http_request_duration_seconds_sum 53423
+http_request_duration_seconds_count 144320
+
+# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5"} 4773
+rpc_duration_seconds_sum 1.7560473e+07
+rpc_duration_seconds_count 2693
+
+untyped_metric 1
+# EOF
+`
+	tm, err := New(&Config{Trap: FakeTrap{}})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+
+	target := Tags{{Category: "target", Value: "sidecar"}}
+	if err := tm.IngestPrometheus(strings.NewReader(input), target); err != nil {
+		t.Fatalf("TrapMetrics.IngestPrometheus() error = %v", err)
+	}
+
+	c, err := tm.CounterFetch("http_requests_total", Tags{{Category: "method", Value: "post"}, {Category: "code", Value: "200"}, target[0]})
+	if err != nil {
+		t.Fatalf("TrapMetrics.CounterFetch() error = %v", err)
+	}
+	if c.Samples[0] != int64(1027) {
+		t.Errorf("counter want 1027 got %v", c.Samples[0])
+	}
+
+	if _, err := tm.GaugeFetch("process_cpu_seconds_total", target); err != nil {
+		t.Errorf("non-integral counter expected as gauge: %s", err)
+	}
+
+	g, err := tm.GaugeFetch("temperature", Tags{{Category: "room", Value: `a "b", c`}, target[0]})
+	if err != nil {
+		t.Fatalf("TrapMetrics.GaugeFetch() error = %v", err)
+	}
+	if g.Samples[0] != 21.5 {
+		t.Errorf("gauge want 21.5 got %v", g.Samples[0])
+	}
+
+	h, err := tm.HistogramFetch("http_request_duration_seconds", target)
+	if err != nil {
+		t.Fatalf("TrapMetrics.HistogramFetch() error = %v", err)
+	}
+	if hist, ok := h.Samples[0].(*circonusllhist.Histogram); !ok || hist.Count() != 144320 {
+		t.Errorf("histogram count want 144320 got %v", h.Samples[0])
+	}
+
+	for _, name := range []string{"rpc_duration_seconds", "rpc_duration_seconds_sum", "rpc_duration_seconds_count"} {
+		tags := target
+		if name == "rpc_duration_seconds" {
+			tags = Tags{{Category: "quantile", Value: "0.5"}, target[0]}
+		}
+		if _, err := tm.GaugeFetch(name, tags); err != nil {
+			t.Errorf("summary %s expected as gauge: %s", name, err)
+		}
+	}
+
+	if _, err := tm.GaugeFetch("untyped_metric", target); err != nil {
+		t.Errorf("untyped expected as gauge: %s", err)
+	}
+}
+
+func TestTrapMetrics_IngestPrometheusHistogramDelta(t *testing.T) {
+	scrape := func(le1, inf int) string {
+		return "# TYPE latency histogram\n" +
+			"latency_bucket{le=\"1\"} " + strconv.Itoa(le1) + "\n" +
+			"latency_bucket{le=\"+Inf\"} " + strconv.Itoa(inf) + "\n"
+	}
+
+	tm, err := New(&Config{Trap: FakeTrap{}})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		want  uint64
+	}{
+		{name: "first scrape", input: scrape(2, 3), want: 3},
+		{name: "same scrape again", input: scrape(2, 3), want: 3},
+		{name: "new observations", input: scrape(4, 6), want: 6},
+		{name: "target restarted", input: scrape(1, 1), want: 7},
+	}
+	for _, tt := range tests {
+		if err := tm.IngestPrometheus(strings.NewReader(tt.input), nil); err != nil {
+			t.Fatalf("%s: TrapMetrics.IngestPrometheus() error = %v", tt.name, err)
+		}
+		v, err := tm.HistogramView("latency", nil)
+		if err != nil {
+			t.Fatalf("%s: TrapMetrics.HistogramView() error = %v", tt.name, err)
+		}
+		if got := v.Count(); got != tt.want {
+			t.Errorf("%s: histogram count want %d got %d", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestTrapMetrics_IngestPrometheusInvalid(t *testing.T) {
+	tm, err := New(&Config{Trap: FakeTrap{}})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+
+	input := "valid 1\ninvalid{a=\"b\" 2\nnovalue\n"
+	err = tm.IngestPrometheus(strings.NewReader(input), nil)
+	if err == nil {
+		t.Fatal("expected error for invalid samples")
+	}
+	if !strings.Contains(err.Error(), "2 invalid") {
+		t.Errorf("unexpected error %s", err)
+	}
+	if _, err := tm.GaugeFetch("valid", nil); err != nil {
+		t.Errorf("valid sample expected to be recorded: %s", err)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTrapMetrics_PrometheusHandler(t *testing.T) {
+	tm, err := New(&Config{Trap: FakeTrap{}, GlobalTags: Tags{{Category: "host", Value: "h1"}}})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+
+	tags := Tags{{Category: "foo", Value: "bar"}}
+	if err := tm.CounterIncrementByValue("requests", tags, 3); err != nil {
+		t.Fatalf("TrapMetrics.CounterIncrementByValue() error = %v", err)
+	}
+	if err := tm.GaugeSet("temp.celsius", tags, 21.5, nil); err != nil {
+		t.Fatalf("TrapMetrics.GaugeSet() error = %v", err)
+	}
+	if err := tm.TextSet("version", nil, `1.0 "beta"`, nil); err != nil {
+		t.Fatalf("TrapMetrics.TextSet() error = %v", err)
+	}
+	if err := tm.HistogramRecordCountForValue("latency", nil, 2, 1.25); err != nil {
+		t.Fatalf("TrapMetrics.HistogramRecordCountForValue() error = %v", err)
+	}
+	if err := tm.HistogramRecordCountForValue("latency", nil, 1, 3); err != nil {
+		t.Fatalf("TrapMetrics.HistogramRecordCountForValue() error = %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	tm.PrometheusHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); ct != promContentType {
+		t.Errorf("content type want %s got %s", promContentType, ct)
+	}
+
+	body, _ := io.ReadAll(rec.Body)
+	got := string(body)
+
+	for _, want := range []string{
+		"# TYPE requests gauge\nrequests{foo=\"bar\",host=\"h1\"} 3\n",
+		"# TYPE temp_celsius gauge\ntemp_celsius{foo=\"bar\",host=\"h1\"} 21.5\n",
+		"# TYPE version_info gauge\nversion_info{host=\"h1\",value=\"1.0 \\\"beta\\\"\"} 1\n",
+		"# TYPE latency histogram\n",
+		"latency_bucket{host=\"h1\",le=\"1.3\"} 2\n",
+		"latency_bucket{host=\"h1\",le=\"3.1\"} 3\n",
+		"latency_bucket{host=\"h1\",le=\"+Inf\"} 3\n",
+		"latency_count{host=\"h1\"} 3\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("prometheus output missing [%s] got:\n%s", want, got)
+		}
+	}
+
+	// metrics are not consumed
+	if _, err := tm.CounterFetch("requests", tags); err != nil {
+		t.Errorf("expected metrics to remain after render: %s", err)
+	}
+}
+
+func TestTrapMetrics_PrometheusCounterType(t *testing.T) {
+	tests := []struct {
+		name       string
+		want       string
+		persistent bool
+	}{
+		{name: "reset each flush", want: "# TYPE requests gauge\nrequests 1\n"},
+		{name: "persistent", persistent: true, want: "# TYPE requests counter\nrequests 1\n"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tm, err := New(&Config{Trap: FakeTrap{}, PersistentCounters: tt.persistent})
+			if err != nil {
+				t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+			}
+			if err := tm.CounterIncrement("requests", nil); err != nil {
+				t.Fatalf("TrapMetrics.CounterIncrement() error = %v", err)
+			}
+
+			var sb strings.Builder
+			if err := tm.WritePrometheus(&sb); err != nil {
+				t.Fatalf("TrapMetrics.WritePrometheus() error = %v", err)
+			}
+			if sb.String() != tt.want {
+				t.Errorf("prometheus output want [%s] got [%s]", tt.want, sb.String())
+			}
+		})
+	}
+}
+
+func TestParseHistogramBin(t *testing.T) {
+	tests := []struct {
+		bin  string
+		want HistogramBucket
+	}{
+		{bin: "H[1.2e+00]=3", want: HistogramBucket{Lower: 1.2, Upper: 1.3, Count: 3}},
+		{bin: "H[9.9e+01]=1", want: HistogramBucket{Lower: 99, Upper: 100, Count: 1}},
+		{bin: "H[-1.2e-03]=2", want: HistogramBucket{Lower: -0.0013, Upper: -0.0012, Count: 2}},
+		{bin: "H[0.0e+00]=4", want: HistogramBucket{Lower: 0, Upper: 0, Count: 4}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.bin, func(t *testing.T) {
+			got, err := parseHistogramBin(tt.bin)
+			if err != nil {
+				t.Fatalf("parseHistogramBin() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("parseHistogramBin() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Start begins flushing metrics to the configured trap check every interval
+// (plus a random amount of up to Config.FlushJitter) until ctx is done or Stop
+// is called. A final flush is performed when the loop shuts down.
+func (tm *TrapMetrics) Start(ctx context.Context, interval time.Duration) error {
+	if tm.trap == nil {
+		return fmt.Errorf("no trap check configured")
+	}
+	if interval <= 0 {
+		return fmt.Errorf("invalid flush interval (%s)", interval)
+	}
+
+	tm.flushmu.Lock()
+	defer tm.flushmu.Unlock()
+
+	if tm.flushDone != nil {
+		return fmt.Errorf("flush loop already running")
+	}
+
+	fctx, cancel := context.WithCancel(ctx)
+	tm.flushCancel = cancel
+	tm.flushDone = make(chan struct{})
+
+	go tm.flushLoop(fctx, interval, tm.flushDone)
+
+	return nil
+}
+
+// Stop ends the flush loop started with Start, waiting for the final flush to complete.
+func (tm *TrapMetrics) Stop() {
+	tm.flushmu.Lock()
+	cancel := tm.flushCancel
+	done := tm.flushDone
+	tm.flushmu.Unlock()
+
+	if cancel == nil {
+		return
+	}
+
+	cancel()
+	<-done
+}
+
+// LastResult returns the result and error from the most recent flush performed by the flush loop.
+func (tm *TrapMetrics) LastResult() (*Result, error) {
+	tm.flushmu.Lock()
+	defer tm.flushmu.Unlock()
+
+	return tm.lastResult, tm.lastErr
+}
+
+func (tm *TrapMetrics) flushLoop(ctx context.Context, interval time.Duration, done chan struct{}) {
+	// clear the loop state on exit (Stop or ctx passed to Start done) so the
+	// loop can be started again
+	defer func() {
+		tm.flushmu.Lock()
+		if tm.flushDone == done {
+			tm.flushCancel()
+			tm.flushCancel = nil
+			tm.flushDone = nil
+		}
+		tm.flushmu.Unlock()
+		close(done)
+	}()
+
+	timer := time.NewTimer(tm.nextFlushDelay(interval))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// final flush, the loop context is already canceled so
+			// give the submission up to one interval to complete
+			fctx, cancel := context.WithTimeout(context.Background(), interval)
+			tm.scheduledFlush(fctx)
+			cancel()
+			return
+		case <-timer.C:
+			tm.scheduledFlush(ctx)
+			timer.Reset(tm.nextFlushDelay(interval))
+		}
+	}
+}
+
+func (tm *TrapMetrics) scheduledFlush(ctx context.Context) {
+	result, err := tm.Flush(ctx)
+	if err != nil {
+		tm.Log.Warnf("scheduled flush: %s", err)
+	}
+
+	tm.flushmu.Lock()
+	tm.lastResult = result
+	tm.lastErr = err
+	tm.flushmu.Unlock()
+}
+
+func (tm *TrapMetrics) nextFlushDelay(interval time.Duration) time.Duration {
+	if tm.flushJitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration(rand.Int63n(int64(tm.flushJitter)))
+}
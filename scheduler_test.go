@@ -0,0 +1,122 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrapMetrics_Start(t *testing.T) {
+	trap := &RecordingTrap{}
+	tm, err := New(&Config{Trap: trap, FlushJitter: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+
+	if err := tm.Start(context.Background(), 0); err == nil {
+		t.Fatal("expected error for invalid interval")
+	}
+
+	if err := tm.Start(context.Background(), 10*time.Millisecond); err != nil {
+		t.Fatalf("TrapMetrics.Start() error = %v", err)
+	}
+	if err := tm.Start(context.Background(), 10*time.Millisecond); err == nil {
+		t.Fatal("expected error when flush loop already running")
+	}
+
+	if err := tm.CounterIncrement("test", nil); err != nil {
+		t.Fatalf("incrementing counter: %s", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(trap.Payloads()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if len(trap.Payloads()) == 0 {
+		t.Fatal("expected scheduled flush to submit metrics")
+	}
+
+	result, err := tm.LastResult()
+	if err != nil {
+		t.Fatalf("LastResult() error = %v", err)
+	}
+	if result == nil {
+		t.Fatal("LastResult() expected result")
+	}
+
+	// final flush on stop
+	if err := tm.CounterIncrement("final", nil); err != nil {
+		t.Fatalf("incrementing counter: %s", err)
+	}
+	tm.Stop()
+
+	payloads := trap.Payloads()
+	if !strings.Contains(string(payloads[len(payloads)-1]), `"final"`) {
+		t.Errorf("expected final flush to include metric, got %s", payloads[len(payloads)-1])
+	}
+
+	// stop is safe to call when not running
+	tm.Stop()
+}
+
+func TestTrapMetrics_StartNoTrap(t *testing.T) {
+	tm, err := New(&Config{})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+
+	if err := tm.Start(context.Background(), time.Second); err == nil {
+		t.Fatal("expected error with no trap configured")
+	}
+}
+
+func TestTrapMetrics_StartAfterCancel(t *testing.T) {
+	trap := &RecordingTrap{}
+	tm, err := New(&Config{Trap: trap})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := tm.Start(ctx, time.Hour); err != nil {
+		t.Fatalf("TrapMetrics.Start() error = %v", err)
+	}
+	if err := tm.CounterIncrement("first", nil); err != nil {
+		t.Fatalf("incrementing counter: %s", err)
+	}
+	cancel()
+
+	// the loop exits (with a final flush) without Stop being called
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		err := tm.Start(context.Background(), time.Hour)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("TrapMetrics.Start() after parent ctx canceled error = %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	payloads := trap.Payloads()
+	if len(payloads) != 1 || !strings.Contains(string(payloads[0]), `"first"`) {
+		t.Errorf("expected final flush of first loop, got %q", payloads)
+	}
+
+	if err := tm.CounterIncrement("second", nil); err != nil {
+		t.Fatalf("incrementing counter: %s", err)
+	}
+	tm.Stop()
+
+	payloads = trap.Payloads()
+	if len(payloads) != 2 || !strings.Contains(string(payloads[1]), `"second"`) {
+		t.Errorf("expected final flush of restarted loop, got %q", payloads)
+	}
+}
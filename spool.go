@@ -0,0 +1,345 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSpoolMaxBytes = int64(64 * 1024 * 1024)
+	defaultSpoolMaxAge   = 24 * time.Hour
+	defaultSpoolAttempts = 5
+	spoolFileExt         = ".json"
+	spoolTempExt         = ".tmp"
+	spoolGzipExt         = ".gz"
+)
+
+// spool stores submissions which failed to send in a local directory so they
+// can be replayed, in order, on subsequent flushes.
+type spool struct {
+	dir         string
+	failed      string // payload which failed the last replay
+	maxBytes    int64
+	maxAge      time.Duration
+	maxAttempts int
+	seq         uint64 // orders payloads spooled within the same clock tick
+	mu          sync.Mutex
+	compress    bool
+}
+
+type spoolFile struct {
+	modTime time.Time
+	path    string
+	size    int64
+}
+
+func newSpool(dir string, maxBytes int64, maxAge time.Duration, maxAttempts int, compress bool) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating spool dir: %w", err)
+	}
+
+	if maxBytes <= 0 {
+		maxBytes = defaultSpoolMaxBytes
+	}
+	if maxAge <= 0 {
+		maxAge = defaultSpoolMaxAge
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = defaultSpoolAttempts
+	}
+
+	return &spool{
+		dir:         dir,
+		maxBytes:    maxBytes,
+		maxAge:      maxAge,
+		maxAttempts: maxAttempts,
+		compress:    compress,
+	}, nil
+}
+
+// store writes a payload to the spool (gzip compressed if enabled), then prunes
+// the spool to its size/age limits.
+func (s *spool) store(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ext := spoolFileExt
+	if s.compress {
+		var buf bytes.Buffer
+		if _, err := writeGzip(&buf, data); err != nil {
+			return fmt.Errorf("compressing spool file: %w", err)
+		}
+		data = buf.Bytes()
+		ext += spoolGzipExt
+	}
+
+	name, err := s.nextName(ext)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, name+spoolTempExt)
+
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("writing spool file: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("renaming spool file: %w", err)
+	}
+
+	return s.prune()
+}
+
+// nextName returns an unused spool file name - the current time and a sequence
+// number, so names sort in the order payloads were spooled and payloads spooled
+// within the same clock tick do not overwrite each other. Caller must hold s.mu.
+func (s *spool) nextName(ext string) (string, error) {
+	now := time.Now().UnixNano()
+	for {
+		s.seq++
+		name := fmt.Sprintf("%020d-%010d", now, s.seq) + ext
+		_, err := os.Lstat(filepath.Join(s.dir, name))
+		if os.IsNotExist(err) {
+			return name, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("checking spool file: %w", err)
+		}
+	}
+}
+
+// replay sends spooled payloads oldest first, removing each one once it has
+// been sent. Payloads the broker rejects (see isPermanentSubmitError), or which
+// can not be read, are dropped. It stops at any other failure, leaving the
+// remaining payloads in the spool (see failedAttempt). Returns the number of
+// payloads sent and dropped.
+func (s *spool) replay(ctx context.Context, send func(context.Context, []byte) error) (int, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failed = ""
+
+	if err := s.prune(); err != nil {
+		return 0, 0, err
+	}
+
+	files, err := s.files()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	sent, dropped := 0, 0
+	for _, f := range files {
+		data, err := os.ReadFile(f.path)
+		if err == nil && strings.HasSuffix(f.path, spoolGzipExt) {
+			data, err = readGzip(data)
+		}
+		if err == nil {
+			err = send(ctx, data)
+			if err != nil && !isPermanentSubmitError(err) {
+				s.failed = f.path
+				return sent, dropped, err
+			}
+		}
+		if rmErr := os.Remove(f.path); rmErr != nil {
+			return sent, dropped, fmt.Errorf("removing spool file: %w", rmErr)
+		}
+		if err != nil {
+			dropped++
+			continue
+		}
+		sent++
+	}
+
+	return sent, dropped, nil
+}
+
+// failedAttempt counts a failed replay against the payload which failed the last
+// replay, it is dropped after maxAttempts. Only called once a newer submission has
+// been accepted - while the broker is unavailable attempts are not counted.
+// Returns true if the payload was dropped.
+func (s *spool) failedAttempt() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := s.failed
+	if path == "" {
+		return false, nil
+	}
+	s.failed = ""
+
+	attempts := spoolAttempts(path) + 1
+	if attempts >= s.maxAttempts {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return false, fmt.Errorf("removing spool file: %w", err)
+		}
+		return true, nil
+	}
+
+	if err := os.Rename(path, spoolAttemptsPath(path, attempts)); err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("renaming spool file: %w", err)
+	}
+
+	return false, nil
+}
+
+// spoolAttempts returns the number of failed replays recorded in a spool file
+// name (<time>-<seq>_<attempts>.json), 0 if none.
+func spoolAttempts(path string) int {
+	base := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(path), spoolGzipExt), spoolFileExt)
+	i := strings.LastIndexByte(base, '_')
+	if i < 0 {
+		return 0
+	}
+	n, err := strconv.Atoi(base[i+1:])
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// spoolAttemptsPath returns path with the number of failed replays set to attempts.
+func spoolAttemptsPath(path string, attempts int) string {
+	ext := spoolFileExt
+	if strings.HasSuffix(path, spoolGzipExt) {
+		ext += spoolGzipExt
+	}
+	base := strings.TrimSuffix(path, ext)
+	if i := strings.LastIndexByte(filepath.Base(base), '_'); i >= 0 {
+		base = base[:len(base)-len(filepath.Base(base))+i]
+	}
+	return base + "_" + strconv.Itoa(attempts) + ext
+}
+
+// isPermanentSubmitError returns true if the broker rejected a submission with a
+// client error, sending it again will not succeed. go-trapcheck reports a failed
+// request as "<status> - <url>". 404 (check is refreshed), 408 and 429 are retried.
+func isPermanentSubmitError(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		msg := err.Error()
+		if len(msg) < 4 || msg[0] != '4' || msg[3] != ' ' {
+			continue
+		}
+		code, convErr := strconv.Atoi(msg[:3])
+		if convErr != nil {
+			continue
+		}
+		switch code {
+		case http.StatusNotFound, http.StatusRequestTimeout, http.StatusTooManyRequests:
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// prune removes payloads older than maxAge, then the oldest payloads
+// until the spool is within maxBytes. Caller must hold s.mu.
+func (s *spool) prune() error {
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	keep := make([]spoolFile, 0, len(files))
+	for _, f := range files {
+		if time.Since(f.modTime) > s.maxAge {
+			if err := os.Remove(f.path); err != nil {
+				return fmt.Errorf("removing expired spool file: %w", err)
+			}
+			continue
+		}
+		keep = append(keep, f)
+		total += f.size
+	}
+
+	for i := 0; total > s.maxBytes && i < len(keep); i++ {
+		if err := os.Remove(keep[i].path); err != nil {
+			return fmt.Errorf("removing spool file: %w", err)
+		}
+		total -= keep[i].size
+	}
+
+	return nil
+}
+
+// files returns the spooled payloads, oldest first.
+func (s *spool) files() ([]spoolFile, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading spool dir: %w", err)
+	}
+
+	files := make([]spoolFile, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || !(strings.HasSuffix(e.Name(), spoolFileExt) || strings.HasSuffix(e.Name(), spoolFileExt+spoolGzipExt)) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue // removed since listing
+		}
+		files = append(files, spoolFile{
+			path:    filepath.Join(s.dir, e.Name()),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].path < files[j].path
+	})
+
+	return files, nil
+}
+
+// replaySpool sends any spooled payloads to the trap check.
+func (tm *TrapMetrics) replaySpool(ctx context.Context) (int, error) {
+	if tm.spool == nil {
+		return 0, nil
+	}
+
+	n, dropped, err := tm.spool.replay(ctx, func(ctx context.Context, data []byte) error {
+		if _, err := tm.trap.SendMetrics(ctx, *bytes.NewBuffer(data)); err != nil {
+			return fmt.Errorf("submitting spooled metrics to broker: %w", err)
+		}
+		return nil
+	})
+	if n > 0 {
+		tm.Log.Infof("replayed %d spooled submission(s)", n)
+	}
+	if dropped > 0 {
+		tm.Log.Warnf("dropped %d spooled submission(s) rejected by broker", dropped)
+	}
+
+	return n, err
+}
+
+// spoolReplayFailed counts a failed replay against the spooled payload which
+// blocked the last replay, now that the broker has accepted a newer submission.
+func (tm *TrapMetrics) spoolReplayFailed() {
+	dropped, err := tm.spool.failedAttempt()
+	if err != nil {
+		tm.Log.Errorf("spooling metrics: %s", err)
+		return
+	}
+	if dropped {
+		tm.Log.Warnf("dropped spooled submission after %d failed replays", tm.spool.maxAttempts)
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/circonus-labs/go-apiclient"
+	"github.com/circonus-labs/go-trapcheck"
+)
+
+// PoisonTrap rejects submissions containing "poison" with err, all others are recorded.
+type PoisonTrap struct {
+	err      error
+	payloads [][]byte
+	mu       sync.Mutex
+}
+
+func (pt *PoisonTrap) SendMetrics(_ context.Context, metrics bytes.Buffer) (*trapcheck.TrapResult, error) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if pt.err != nil && bytes.Contains(metrics.Bytes(), []byte("poison")) {
+		return nil, pt.err
+	}
+	pt.payloads = append(pt.payloads, append([]byte(nil), metrics.Bytes()...))
+	return &trapcheck.TrapResult{Stats: 1, BytesSent: metrics.Len()}, nil
+}
+func (pt *PoisonTrap) UpdateCheckTags(_ context.Context, _ []string) (*apiclient.CheckBundle, error) {
+	return nil, nil
+}
+
+func TestTrapMetrics_FlushSpool(t *testing.T) {
+	trap := &RecordingTrap{}
+	tm, err := New(&Config{Trap: trap, SpoolDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+
+	ctx := context.Background()
+
+	// broker unavailable, submissions are spooled
+	trap.setErr(errors.New("broker unavailable"))
+	for _, name := range []string{"first", "second"} {
+		if err := tm.CounterIncrement(name, nil); err != nil {
+			t.Fatalf("TrapMetrics.CounterIncrement() error = %v", err)
+		}
+		if _, err := tm.Flush(ctx); err == nil {
+			t.Fatal("expected flush error")
+		} else if !strings.Contains(err.Error(), "spooled") {
+			t.Errorf("expected spooled error, got %s", err)
+		}
+	}
+
+	files, err := tm.spool.files()
+	if err != nil {
+		t.Fatalf("listing spool: %s", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("spool files want 2 got %d", len(files))
+	}
+
+	// broker available, spool is replayed in order before the current submission
+	trap.setErr(nil)
+	if err := tm.CounterIncrement("third", nil); err != nil {
+		t.Fatalf("TrapMetrics.CounterIncrement() error = %v", err)
+	}
+	result, err := tm.Flush(ctx)
+	if err != nil {
+		t.Fatalf("TrapMetrics.Flush() error = %v", err)
+	}
+	if result.Replayed != 2 {
+		t.Errorf("replayed want 2 got %d", result.Replayed)
+	}
+
+	payloads := trap.Payloads()
+	if len(payloads) != 3 {
+		t.Fatalf("payloads want 3 got %d", len(payloads))
+	}
+	for i, name := range []string{"first", "second", "third"} {
+		if !strings.Contains(string(payloads[i]), `"`+name+`"`) {
+			t.Errorf("payload %d want %s got %s", i, name, payloads[i])
+		}
+	}
+
+	if files, _ := tm.spool.files(); len(files) != 0 {
+		t.Errorf("spool files want 0 got %d", len(files))
+	}
+}
+
+func TestSpool_Prune(t *testing.T) {
+	s, err := newSpool(t.TempDir(), 10, 0, 0, false)
+	if err != nil {
+		t.Fatalf("newSpool() error = %v", err)
+	}
+
+	for _, data := range []string{"123456", "abcdef"} {
+		if err := s.store([]byte(data)); err != nil {
+			t.Fatalf("store() error = %v", err)
+		}
+	}
+
+	files, err := s.files()
+	if err != nil {
+		t.Fatalf("files() error = %v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("spool files want 1 got %d", len(files))
+	}
+
+	var got []string
+	n, _, err := s.replay(context.Background(), func(_ context.Context, data []byte) error {
+		got = append(got, string(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("replay() error = %v", err)
+	}
+	if n != 1 || got[0] != "abcdef" {
+		t.Errorf("replay want newest payload, got %d %v", n, got)
+	}
+}
+
+func TestSpool_Compress(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newSpool(dir, 0, 0, 0, true)
+	if err != nil {
+		t.Fatalf("newSpool() error = %v", err)
+	}
+
+	data := `{"foo":{"_type":"l","_ts":1,"_value":"1"}}`
+	if err := s.store([]byte(data)); err != nil {
+		t.Fatalf("store() error = %v", err)
+	}
+
+	files, err := s.files()
+	if err != nil {
+		t.Fatalf("files() error = %v", err)
+	}
+	if len(files) != 1 || !strings.HasSuffix(files[0].path, spoolFileExt+spoolGzipExt) {
+		t.Fatalf("spool files want 1 compressed got %v", files)
+	}
+
+	// payloads spooled before compression was enabled are still replayed
+	plain, err := newSpool(dir, 0, 0, 0, false)
+	if err != nil {
+		t.Fatalf("newSpool() error = %v", err)
+	}
+	if err := plain.store([]byte(data)); err != nil {
+		t.Fatalf("store() error = %v", err)
+	}
+
+	var got []string
+	n, _, err := s.replay(context.Background(), func(_ context.Context, data []byte) error {
+		got = append(got, string(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("replay() error = %v", err)
+	}
+	if n != 2 || got[0] != data || got[1] != data {
+		t.Errorf("replay want 2 decompressed payloads, got %d %v", n, got)
+	}
+}
+
+func TestSpool_SameTick(t *testing.T) {
+	s, err := newSpool(t.TempDir(), 0, 0, 0, false)
+	if err != nil {
+		t.Fatalf("newSpool() error = %v", err)
+	}
+
+	want := []string{"first", "second", "third"}
+	for _, data := range want {
+		if err := s.store([]byte(data)); err != nil {
+			t.Fatalf("store() error = %v", err)
+		}
+	}
+
+	// names are unique and ordered even if the clock did not advance
+	names := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		s.mu.Lock()
+		name, err := s.nextName(spoolFileExt)
+		s.mu.Unlock()
+		if err != nil {
+			t.Fatalf("nextName() error = %v", err)
+		}
+		if names[name] {
+			t.Errorf("nextName() duplicate name %s", name)
+		}
+		names[name] = true
+	}
+
+	var got []string
+	if _, _, err := s.replay(context.Background(), func(_ context.Context, data []byte) error {
+		got = append(got, string(data))
+		return nil
+	}); err != nil {
+		t.Fatalf("replay() error = %v", err)
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("replay want %v got %v", want, got)
+	}
+}
+
+func TestTrapMetrics_FlushSpoolPoison(t *testing.T) {
+	tests := []struct {
+		err     error
+		name    string
+		flushes int // flushes until the poison payload is dropped
+	}{
+		{name: "rejected", err: errors.New("400 Bad Request - https://broker/"), flushes: 1},
+		{name: "max attempts", err: errors.New("500 Internal Server Error - https://broker/"), flushes: 2},
+		{name: "not found retried", err: errors.New("404 Not Found - https://broker/"), flushes: 2},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			trap := &PoisonTrap{err: tt.err}
+			tm, err := New(&Config{Trap: trap, SpoolDir: t.TempDir(), SpoolMaxAttempts: 2})
+			if err != nil {
+				t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+			}
+
+			ctx := context.Background()
+
+			if err := tm.CounterIncrement("poison", nil); err != nil {
+				t.Fatalf("TrapMetrics.CounterIncrement() error = %v", err)
+			}
+			if _, err := tm.Flush(ctx); err == nil {
+				t.Fatal("expected flush error")
+			}
+
+			// the poison payload does not block newer submissions
+			for i := 1; i <= tt.flushes; i++ {
+				if files, _ := tm.spool.files(); len(files) != 1 {
+					t.Fatalf("flush %d spool files want 1 got %d", i, len(files))
+				}
+				if err := tm.CounterIncrement("healthy", nil); err != nil {
+					t.Fatalf("TrapMetrics.CounterIncrement() error = %v", err)
+				}
+				if _, err := tm.Flush(ctx); err != nil {
+					t.Fatalf("flush %d error = %v", i, err)
+				}
+				if got := len(trap.payloads); got != i {
+					t.Errorf("flush %d payloads want %d got %d", i, i, got)
+				}
+			}
+
+			if files, _ := tm.spool.files(); len(files) != 0 {
+				t.Errorf("spool files want 0 got %d", len(files))
+			}
+		})
+	}
+}
@@ -0,0 +1,441 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultStatsdUDPAddr  = ":8125"
+	defaultStatsdStateTTL = time.Hour
+	statsdMaxPacketSize   = 65535
+)
+
+// StatsdConfig defines the listeners for a StatsD server.
+type StatsdConfig struct {
+	// UDPAddr address to listen on for UDP packets (default: ":8125")
+	UDPAddr string
+
+	// TCPAddr address to listen on for newline delimited TCP streams (default: "" disabled)
+	TCPAddr string
+
+	// Tags is a list of tags to be added to every metric received
+	Tags Tags
+
+	// StateTTL the last value of a gauge and the members of a set are discarded when
+	// the metric has not been received for at least this long (default 1h). A signed
+	// gauge value received after that adjusts 0.
+	StateTTL time.Duration
+}
+
+// StatsdServer receives StatsD (and DogStatsD) metrics and records them in a TrapMetrics container.
+//
+//   - c (counter) -> CounterIncrementByValue (CounterAdjustByValue for negative values), scaled by sample rate
+//   - g (gauge) -> GaugeSet, a signed value (e.g. +3, -2) adjusts the last value
+//     received for the gauge, which is kept across flushes
+//   - ms, h, d (timer, histogram, distribution) -> HistogramRecordCountForValue, count scaled by sample rate
+//   - s (set) -> gauge with the number of unique values seen since the last flush
+//
+// DogStatsD tags (|#tag:value,tag) are mapped to Tags, events and service checks are ignored.
+type StatsdServer struct {
+	lastPrune time.Time
+	tm        *TrapMetrics
+	udp       net.PacketConn
+	tcp       net.Listener
+	cancel    context.CancelFunc
+	done      chan struct{}
+	sets      map[string]*statsdSet
+	gauges    map[string]*statsdGauge
+	conns     map[net.Conn]struct{}
+	udpAddr   string
+	tcpAddr   string
+	tags      Tags
+	stateTTL  time.Duration
+	setsmu    sync.Mutex
+	gaugesmu  sync.Mutex
+	connsmu   sync.Mutex
+	statemu   sync.Mutex
+	prunemu   sync.Mutex
+}
+
+// statsdSet is the unique values received for a set.
+type statsdSet struct {
+	seen    time.Time
+	members map[string]struct{}
+}
+
+// statsdGauge is the last value received for a gauge.
+type statsdGauge struct {
+	seen  time.Time
+	value float64
+}
+
+// NewStatsdServer returns a StatsD server recording metrics in tm.
+func NewStatsdServer(tm *TrapMetrics, cfg *StatsdConfig) (*StatsdServer, error) {
+	if tm == nil {
+		return nil, fmt.Errorf("invalid trap metrics (nil)")
+	}
+	if cfg == nil {
+		return nil, fmt.Errorf("invalid config (nil)")
+	}
+
+	s := &StatsdServer{
+		tm:        tm,
+		udpAddr:   cfg.UDPAddr,
+		tcpAddr:   cfg.TCPAddr,
+		tags:      cfg.Tags,
+		stateTTL:  cfg.StateTTL,
+		sets:      make(map[string]*statsdSet),
+		gauges:    make(map[string]*statsdGauge),
+		conns:     make(map[net.Conn]struct{}),
+		lastPrune: time.Now(),
+	}
+
+	if s.udpAddr == "" {
+		s.udpAddr = defaultStatsdUDPAddr
+	}
+	if s.stateTTL <= 0 {
+		s.stateTTL = defaultStatsdStateTTL
+	}
+
+	return s, nil
+}
+
+// Start opens the listeners and begins receiving metrics until ctx is done or Stop is called.
+func (s *StatsdServer) Start(ctx context.Context) error {
+	s.statemu.Lock()
+	defer s.statemu.Unlock()
+
+	if s.done != nil {
+		return fmt.Errorf("statsd server already running")
+	}
+
+	udp, err := net.ListenPacket("udp", s.udpAddr)
+	if err != nil {
+		return fmt.Errorf("statsd udp listener: %w", err)
+	}
+
+	var tcp net.Listener
+	if s.tcpAddr != "" {
+		tcp, err = net.Listen("tcp", s.tcpAddr)
+		if err != nil {
+			_ = udp.Close()
+			return fmt.Errorf("statsd tcp listener: %w", err)
+		}
+	}
+
+	sctx, cancel := context.WithCancel(ctx)
+	s.udp = udp
+	s.tcp = tcp
+	s.cancel = cancel
+	s.done = make(chan struct{})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go s.serveUDP(sctx, udp, &wg)
+	if tcp != nil {
+		wg.Add(1)
+		go s.serveTCP(sctx, tcp, &wg)
+	}
+
+	go s.run(sctx, &wg, s.done)
+
+	return nil
+}
+
+// Stop closes the listeners and waits for in-flight metrics to be recorded.
+func (s *StatsdServer) Stop() {
+	s.statemu.Lock()
+	cancel := s.cancel
+	done := s.done
+	s.statemu.Unlock()
+
+	if cancel == nil {
+		return
+	}
+
+	cancel()
+	<-done
+}
+
+// UDPAddr returns the address of the UDP listener (nil if not running).
+func (s *StatsdServer) UDPAddr() net.Addr {
+	s.statemu.Lock()
+	defer s.statemu.Unlock()
+	if s.udp == nil {
+		return nil
+	}
+	return s.udp.LocalAddr()
+}
+
+// TCPAddr returns the address of the TCP listener (nil if not running or not configured).
+func (s *StatsdServer) TCPAddr() net.Addr {
+	s.statemu.Lock()
+	defer s.statemu.Unlock()
+	if s.tcp == nil {
+		return nil
+	}
+	return s.tcp.Addr()
+}
+
+// run closes the listeners once ctx is done (Stop or ctx passed to Start done),
+// then clears the listener state so the server can be started again.
+func (s *StatsdServer) run(ctx context.Context, wg *sync.WaitGroup, done chan struct{}) {
+	<-ctx.Done()
+
+	s.statemu.Lock()
+	udp, tcp := s.udp, s.tcp
+	s.statemu.Unlock()
+
+	_ = udp.Close()
+	if tcp != nil {
+		_ = tcp.Close()
+	}
+
+	s.connsmu.Lock()
+	for c := range s.conns {
+		_ = c.Close()
+	}
+	s.connsmu.Unlock()
+
+	wg.Wait()
+
+	s.statemu.Lock()
+	if s.done == done {
+		s.cancel()
+		s.udp = nil
+		s.tcp = nil
+		s.cancel = nil
+		s.done = nil
+	}
+	s.statemu.Unlock()
+	close(done)
+}
+
+func (s *StatsdServer) serveUDP(ctx context.Context, udp net.PacketConn, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	buf := make([]byte, statsdMaxPacketSize)
+	for {
+		n, _, err := udp.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.tm.Log.Warnf("statsd udp read: %s", err)
+			continue
+		}
+		for _, line := range bytes.Split(buf[:n], []byte("\n")) {
+			s.handleLine(string(line))
+		}
+	}
+}
+
+func (s *StatsdServer) serveTCP(ctx context.Context, tcp net.Listener, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for {
+		conn, err := tcp.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.tm.Log.Warnf("statsd tcp accept: %s", err)
+			continue
+		}
+
+		// connections are closed by run once ctx is done, one accepted after
+		// that is closed here
+		s.connsmu.Lock()
+		if ctx.Err() != nil {
+			s.connsmu.Unlock()
+			_ = conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.connsmu.Unlock()
+
+		wg.Add(1)
+		go s.serveConn(conn, wg)
+	}
+}
+
+func (s *StatsdServer) serveConn(conn net.Conn, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer func() {
+		s.connsmu.Lock()
+		delete(s.conns, conn)
+		s.connsmu.Unlock()
+		_ = conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), statsdMaxPacketSize)
+	for scanner.Scan() {
+		s.handleLine(scanner.Text())
+	}
+}
+
+func (s *StatsdServer) handleLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "_e{") || strings.HasPrefix(line, "_sc|") {
+		return
+	}
+	if err := s.record(line); err != nil {
+		s.tm.Log.Debugf("statsd (%s): %s", line, err)
+	}
+}
+
+// record parses a single statsd line: <name>:<value>|<type>[|@<rate>][|#<tag>[:<value>],...].
+func (s *StatsdServer) record(line string) error {
+	sep := strings.LastIndex(strings.SplitN(line, "|", 2)[0], ":")
+	if sep <= 0 {
+		return fmt.Errorf("invalid metric, missing value")
+	}
+	name := line[:sep]
+
+	parts := strings.Split(line[sep+1:], "|")
+	if len(parts) < 2 {
+		return fmt.Errorf("invalid metric, missing type")
+	}
+	rawValue, mtype := parts[0], parts[1]
+
+	rate := 1.0
+	tags := append(Tags{}, s.tags...)
+	for _, p := range parts[2:] {
+		switch {
+		case strings.HasPrefix(p, "@"):
+			r, err := strconv.ParseFloat(p[1:], 64)
+			if err != nil || r <= 0 || r > 1 {
+				return fmt.Errorf("invalid sample rate (%s)", p)
+			}
+			rate = r
+		case strings.HasPrefix(p, "#"):
+			for _, t := range strings.Split(p[1:], ",") {
+				if t == "" {
+					continue
+				}
+				kv := strings.SplitN(t, ":", 2)
+				tag := Tag{Category: kv[0]}
+				if len(kv) == 2 {
+					tag.Value = kv[1]
+				}
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	s.pruneState(time.Now())
+
+	if mtype == "s" {
+		return s.recordSet(name, tags, rawValue)
+	}
+
+	val, err := strconv.ParseFloat(rawValue, 64)
+	if err != nil {
+		return fmt.Errorf("invalid value: %w", err)
+	}
+	if math.IsNaN(val) || math.IsInf(val, 0) {
+		return fmt.Errorf("invalid value (%s)", rawValue)
+	}
+
+	switch mtype {
+	case "c":
+		v := int64(math.Round(val / rate))
+		if v < 0 {
+			return s.tm.CounterAdjustByValue(name, tags, v)
+		}
+		return s.tm.CounterIncrementByValue(name, tags, uint64(v))
+	case "g":
+		return s.recordGauge(name, tags, val, strings.HasPrefix(rawValue, "+") || strings.HasPrefix(rawValue, "-"))
+	case "ms", "h", "d":
+		count := int64(math.Round(1 / rate))
+		return s.tm.HistogramRecordCountForValue(name, tags, count, val)
+	default:
+		return fmt.Errorf("unsupported metric type (%s)", mtype)
+	}
+}
+
+// recordGauge sets a gauge, a delta is applied to the last value received for
+// the gauge. The last value is kept by the server since the gauge is removed
+// from the container when it is flushed.
+func (s *StatsdServer) recordGauge(name string, tags Tags, val float64, delta bool) error {
+	key := name + "|" + tags.String()
+
+	s.gaugesmu.Lock()
+	defer s.gaugesmu.Unlock()
+
+	g, ok := s.gauges[key]
+	if !ok {
+		g = &statsdGauge{}
+		s.gauges[key] = g
+	}
+	if delta {
+		val += g.value
+	}
+	g.value = val
+	g.seen = time.Now()
+
+	return s.tm.GaugeSet(name, tags, val, nil)
+}
+
+// recordSet tracks unique values for a set, reported as a gauge of the number of
+// unique values. Once the gauge has been flushed from the container tracking restarts.
+func (s *StatsdServer) recordSet(name string, tags Tags, member string) error {
+	key := name + "|" + tags.String()
+
+	s.setsmu.Lock()
+	defer s.setsmu.Unlock()
+
+	set, ok := s.sets[key]
+	if _, err := s.tm.GaugeFetch(name, tags); !ok || err != nil {
+		set = &statsdSet{members: make(map[string]struct{})}
+		s.sets[key] = set
+	}
+	set.members[member] = struct{}{}
+	set.seen = time.Now()
+
+	return s.tm.GaugeSet(name, tags, uint64(len(set.members)), nil)
+}
+
+// pruneState discards the last values of gauges and members of sets not received
+// within the state TTL, checked at most once per TTL.
+func (s *StatsdServer) pruneState(now time.Time) {
+	s.prunemu.Lock()
+	if now.Sub(s.lastPrune) < s.stateTTL {
+		s.prunemu.Unlock()
+		return
+	}
+	s.lastPrune = now
+	s.prunemu.Unlock()
+
+	s.gaugesmu.Lock()
+	for key, g := range s.gauges {
+		if now.Sub(g.seen) >= s.stateTTL {
+			delete(s.gauges, key)
+		}
+	}
+	s.gaugesmu.Unlock()
+
+	s.setsmu.Lock()
+	for key, set := range s.sets {
+		if now.Sub(set.seen) >= s.stateTTL {
+			delete(s.sets, key)
+		}
+	}
+	s.setsmu.Unlock()
+}
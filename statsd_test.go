@@ -0,0 +1,227 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/openhistogram/circonusllhist"
+)
+
+func TestStatsdServer_record(t *testing.T) {
+	tm, err := New(&Config{Trap: FakeTrap{}})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+	s, err := NewStatsdServer(tm, &StatsdConfig{Tags: Tags{{Category: "src", Value: "statsd"}}})
+	if err != nil {
+		t.Fatalf("NewStatsdServer() error = %v", err)
+	}
+
+	tests := []struct {
+		line    string
+		wantErr bool
+	}{
+		{line: "requests:1|c"},
+		{line: "requests:2|c|@0.5"},
+		{line: "errors:1|c|#env:prod,canary"},
+		{line: "temp:21.5|g"},
+		{line: "queue:10|g"},
+		{line: "queue:-3|g"},
+		{line: "latency:320|ms"},
+		{line: "latency:100|ms|@0.1"},
+		{line: "users:alice|s"},
+		{line: "users:bob|s"},
+		{line: "users:alice|s"},
+		{line: "bad", wantErr: true},
+		{line: "bad:1", wantErr: true},
+		{line: "bad:x|c", wantErr: true},
+		{line: "bad:1|z", wantErr: true},
+		{line: "bad:1|c|@2", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := s.record(tt.line); (err != nil) != tt.wantErr {
+			t.Errorf("record(%s) error = %v, wantErr %v", tt.line, err, tt.wantErr)
+		}
+	}
+
+	src := Tag{Category: "src", Value: "statsd"}
+
+	if m, err := tm.CounterFetch("requests", Tags{src}); err != nil {
+		t.Errorf("counter: %s", err)
+	} else if m.Samples[0] != int64(5) {
+		t.Errorf("counter want 5 got %v", m.Samples[0])
+	}
+	if _, err := tm.CounterFetch("errors", Tags{src, {Category: "env", Value: "prod"}, {Category: "canary"}}); err != nil {
+		t.Errorf("tagged counter: %s", err)
+	}
+	if m, err := tm.GaugeFetch("queue", Tags{src}); err != nil {
+		t.Errorf("gauge: %s", err)
+	} else if m.Samples[0] != float64(7) {
+		t.Errorf("gauge want 7 got %v", m.Samples[0])
+	}
+	if m, err := tm.HistogramFetch("latency", Tags{src}); err != nil {
+		t.Errorf("histogram: %s", err)
+	} else if h, ok := m.Samples[0].(*circonusllhist.Histogram); !ok || h.Count() != 11 {
+		t.Errorf("histogram count want 11 got %v", m.Samples[0])
+	}
+	if m, err := tm.GaugeFetch("users", Tags{src}); err != nil {
+		t.Errorf("set: %s", err)
+	} else if m.Samples[0] != uint64(2) {
+		t.Errorf("set want 2 got %v", m.Samples[0])
+	}
+
+	// set tracking restarts after flush, gauge deltas apply to the last value
+	if _, err := tm.JSONMetrics(); err != nil {
+		t.Fatalf("flushing metrics: %s", err)
+	}
+	if err := s.record("queue:-2|g"); err != nil {
+		t.Fatalf("record() error = %v", err)
+	}
+	if m, err := tm.GaugeFetch("queue", Tags{src}); err != nil {
+		t.Errorf("gauge: %s", err)
+	} else if m.Samples[0] != float64(5) {
+		t.Errorf("gauge delta after flush want 5 got %v", m.Samples[0])
+	}
+	if err := s.record("users:alice|s"); err != nil {
+		t.Fatalf("record() error = %v", err)
+	}
+	if m, err := tm.GaugeFetch("users", Tags{src}); err != nil {
+		t.Errorf("set: %s", err)
+	} else if m.Samples[0] != uint64(1) {
+		t.Errorf("set after flush want 1 got %v", m.Samples[0])
+	}
+}
+
+func TestStatsdServer_Start(t *testing.T) {
+	tm, err := New(&Config{Trap: FakeTrap{}})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+	s, err := NewStatsdServer(tm, &StatsdConfig{UDPAddr: "127.0.0.1:0", TCPAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("NewStatsdServer() error = %v", err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer s.Stop()
+
+	udp, err := net.Dial("udp", s.UDPAddr().String())
+	if err != nil {
+		t.Fatalf("dial udp: %s", err)
+	}
+	defer udp.Close()
+	if _, err := fmt.Fprint(udp, "udp_counter:1|c\nudp_counter:2|c"); err != nil {
+		t.Fatalf("write udp: %s", err)
+	}
+
+	tcp, err := net.Dial("tcp", s.TCPAddr().String())
+	if err != nil {
+		t.Fatalf("dial tcp: %s", err)
+	}
+	defer tcp.Close()
+	if _, err := fmt.Fprint(tcp, "tcp_gauge:3|g\n"); err != nil {
+		t.Fatalf("write tcp: %s", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		c, cerr := tm.CounterFetch("udp_counter", nil)
+		_, gerr := tm.GaugeFetch("tcp_gauge", nil)
+		if cerr == nil && gerr == nil && c.Samples[0] == int64(3) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("expected metrics received over udp and tcp")
+}
+
+func TestStatsdServer_Restart(t *testing.T) {
+	tm, err := New(&Config{Trap: FakeTrap{}})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+	s, err := NewStatsdServer(tm, &StatsdConfig{UDPAddr: "127.0.0.1:0", TCPAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("NewStatsdServer() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := s.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if err := s.Start(ctx); err == nil {
+		t.Error("Start() expected error, already running")
+	}
+	cancel()
+
+	// listener state is cleared once the server has shut down
+	deadline := time.Now().Add(2 * time.Second)
+	for s.UDPAddr() != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if addr := s.UDPAddr(); addr != nil {
+		t.Fatalf("UDPAddr() = %s, want nil after ctx done", addr)
+	}
+
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("Start() after ctx done error = %v", err)
+	}
+	if s.UDPAddr() == nil || s.TCPAddr() == nil {
+		t.Error("expected listeners after restart")
+	}
+	s.Stop()
+	if s.UDPAddr() != nil || s.TCPAddr() != nil {
+		t.Error("expected no listeners after Stop")
+	}
+	s.Stop()
+}
+
+func TestStatsdServer_StateTTL(t *testing.T) {
+	tm, err := New(&Config{Trap: FakeTrap{}})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+	s, err := NewStatsdServer(tm, &StatsdConfig{StateTTL: time.Minute})
+	if err != nil {
+		t.Fatalf("NewStatsdServer() error = %v", err)
+	}
+
+	for _, line := range []string{"queue:10|g", "users:alice|s", "users:bob|s"} {
+		if err := s.record(line); err != nil {
+			t.Fatalf("record(%s) error = %v", line, err)
+		}
+	}
+
+	// pruned at most once per TTL
+	s.pruneState(time.Now().Add(30 * time.Second))
+	if len(s.gauges) != 1 || len(s.sets) != 1 {
+		t.Fatalf("state gauges %d sets %d, want 1 and 1", len(s.gauges), len(s.sets))
+	}
+
+	s.pruneState(time.Now().Add(2 * time.Minute))
+	if len(s.gauges) != 0 || len(s.sets) != 0 {
+		t.Fatalf("state gauges %d sets %d, want expired", len(s.gauges), len(s.sets))
+	}
+
+	// a delta after expiry adjusts 0
+	if _, err := tm.JSONMetrics(); err != nil {
+		t.Fatalf("flushing metrics: %s", err)
+	}
+	if err := s.record("queue:+2|g"); err != nil {
+		t.Fatalf("record() error = %v", err)
+	}
+	if m, err := tm.GaugeFetch("queue", nil); err != nil {
+		t.Errorf("gauge: %s", err)
+	} else if m.Samples[0] != float64(2) {
+		t.Errorf("gauge after expiry want 2 got %v", m.Samples[0])
+	}
+}
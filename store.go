@@ -0,0 +1,92 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"sync"
+	"unsafe"
+)
+
+const (
+	// metricShards number of shards in a metric store (power of two).
+	metricShards = 64
+	// cacheLineSize shards are padded to a cache line so locking one shard does
+	// not contend with its neighbours (false sharing).
+	cacheLineSize = 64
+)
+
+// metricShard is a subset of a container's metrics, guarded by its own lock.
+type metricShard struct {
+	metrics Metrics
+	mu      sync.Mutex
+	_       [cacheLineSize - unsafe.Sizeof(Metrics(nil)) - unsafe.Sizeof(sync.Mutex{})]byte
+}
+
+// metricStore holds the metrics of a container sharded by metric ID, so
+// recording different metrics does not contend on a single lock.
+type metricStore struct {
+	shards [metricShards]metricShard
+}
+
+func newMetricStore() *metricStore {
+	s := &metricStore{}
+	for i := range s.shards {
+		s.shards[i].metrics = make(Metrics)
+	}
+	return s
+}
+
+// shard returns the shard holding the metric with the given ID.
+func (s *metricStore) shard(id uint64) *metricShard {
+	return &s.shards[id&(metricShards-1)]
+}
+
+// swap replaces the metrics in each shard with the result of fn, which is
+// passed the current metrics of the shard (while its lock is held) and returns
+// the metrics to carry into the new map. The previous metrics of all shards
+// are returned.
+func (s *metricStore) swap(fn func(old, cur Metrics)) Metrics {
+	snapshot := make(Metrics)
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		old := sh.metrics
+		sh.metrics = make(Metrics)
+		fn(old, sh.metrics)
+		sh.mu.Unlock()
+
+		for id, m := range old {
+			snapshot[id] = m
+		}
+	}
+	return snapshot
+}
+
+// each calls fn for every metric, holding the lock of the metric's shard.
+func (s *metricStore) each(fn func(m *Metric)) {
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		for _, m := range sh.metrics {
+			fn(m)
+		}
+		sh.mu.Unlock()
+	}
+}
+
+// merge adds the metric to the shard, merging it with an existing metric with the same ID.
+func (sh *metricShard) merge(id uint64, m *Metric) error {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	cur, ok := sh.metrics[id]
+	if !ok {
+		sh.metrics[id] = m
+		return nil
+	}
+
+	return mergeMetric(cur, m)
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2021 Circonus, Inc. <support@circonus.com>
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+
+package trapmetrics
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+)
+
+func TestMetricShard_Size(t *testing.T) {
+	if size := unsafe.Sizeof(metricShard{}); size != cacheLineSize {
+		t.Errorf("metricShard size want %d got %d", cacheLineSize, size)
+	}
+}
+
+func TestTrapMetrics_ConcurrentRecordFlush(t *testing.T) {
+	tm, err := New(&Config{Trap: FakeTrap{}})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+
+	const (
+		workers    = 8
+		increments = 2000
+	)
+
+	var total int64
+	collect := func() {
+		data, err := tm.JSONMetrics()
+		if err != nil {
+			return // no metrics
+		}
+		metrics, err := DecodeJSONMetrics(data)
+		if err != nil {
+			t.Errorf("DecodeJSONMetrics() error = %v", err)
+			return
+		}
+		for _, m := range metrics {
+			for _, v := range m.Samples {
+				if i, ok := v.(int64); ok {
+					atomic.AddInt64(&total, i)
+				}
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	var flusher sync.WaitGroup
+	flusher.Add(1)
+	go func() {
+		defer flusher.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				collect()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				if err := tm.CounterIncrement(fmt.Sprintf("counter%d", i%16), nil); err != nil {
+					t.Errorf("TrapMetrics.CounterIncrement() error = %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(done)
+	flusher.Wait()
+	collect()
+
+	if total != workers*increments {
+		t.Errorf("total increments want %d got %d", workers*increments, total)
+	}
+}
+
+func benchmarkNames(n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("metric%d", i)
+	}
+	return names
+}
+
+func BenchmarkCounterIncrementParallel(b *testing.B) {
+	tm, _ := New(&Config{})
+	names := benchmarkNames(1024)
+	tags := Tags{{Category: "foo", Value: "bar"}}
+	var next uint64
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint64(&next, 1))
+		for pb.Next() {
+			_ = tm.CounterIncrement(names[i%len(names)], tags)
+			i++
+		}
+	})
+}
+
+func BenchmarkHistogramRecordValueParallel(b *testing.B) {
+	tm, _ := New(&Config{})
+	names := benchmarkNames(1024)
+	tags := Tags{{Category: "foo", Value: "bar"}}
+	var next uint64
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint64(&next, 1))
+		for pb.Next() {
+			_ = tm.HistogramRecordValue(names[i%len(names)], tags, float64(i%1000))
+			i++
+		}
+	})
+}
+
+func BenchmarkCounterIncrementDuringFlush(b *testing.B) {
+	tm, _ := New(&Config{})
+	names := benchmarkNames(1024)
+	var next uint64
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				_, _ = tm.JSONMetrics()
+			}
+		}
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint64(&next, 1))
+		for pb.Next() {
+			_ = tm.CounterIncrement(names[i%len(names)], nil)
+			i++
+		}
+	})
+	b.StopTimer()
+
+	close(done)
+	wg.Wait()
+}
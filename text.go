@@ -22,12 +22,13 @@ func (tm *TrapMetrics) TextSet(name string, tags Tags, val string, ts *time.Time
 	}
 	sampleKey := generateSampleKey(ts)
 
-	tm.metricsmu.Lock()
-	defer tm.metricsmu.Unlock()
+	sh := tm.metrics.shard(metricID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
 	value := tm.cleanTextValue(val)
 
-	if m, ok := tm.metrics[metricID]; ok {
+	if m, ok := sh.metrics[metricID]; ok {
 		if m.Mtype != mtText {
 			return fmt.Errorf("(%s %s) exists with different type (text) vs (%s)", name, tags.String(), m.Mtype)
 		}
@@ -42,7 +43,7 @@ func (tm *TrapMetrics) TextSet(name string, tags Tags, val string, ts *time.Time
 	m.Rtype = rtString
 	m.Samples[sampleKey] = value
 
-	tm.metrics[m.ID] = m
+	sh.metrics[m.ID] = m
 
 	return nil
 }
@@ -54,10 +55,11 @@ func (tm *TrapMetrics) TextFetch(name string, tags Tags) (*Metric, error) {
 		return nil, err
 	}
 
-	tm.metricsmu.Lock()
-	defer tm.metricsmu.Unlock()
+	sh := tm.metrics.shard(metricID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	if m, ok := tm.metrics[metricID]; ok {
+	if m, ok := sh.metrics[metricID]; ok {
 		return m, nil
 	}
 
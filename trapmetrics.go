@@ -44,23 +44,97 @@ type Config struct {
 	// Trap ID (used for caching check bundle)
 	TrapID string
 
+	// SpoolDir directory where submissions which fail to send are stored and replayed,
+	// in order, on subsequent flushes (default: "" spooling disabled)
+	SpoolDir string
+
 	// GlobalTags is a list of tags to be added to every metric
 	GlobalTags Tags
 
 	// BufferSize size of metric buffer (when flushing), default is defaultBufferSize above
 	BufferSize uint
+
+	// MaxPayloadBytes maximum size of a single submission, metrics are split across
+	// multiple submissions when exceeded (default: 0 no limit)
+	MaxPayloadBytes int
+
+	// MaxPayloadMetrics maximum number of metric samples in a single submission, metrics
+	// are split across multiple submissions when exceeded (default: 0 no limit)
+	MaxPayloadMetrics int
+
+	// SpoolMaxBytes maximum total size of spooled submissions, oldest are removed first (default: 64MB)
+	SpoolMaxBytes int64
+
+	// SpoolMaxAge maximum age of spooled submissions (default: 24h)
+	SpoolMaxAge time.Duration
+
+	// SpoolMaxAttempts number of flushes a spooled submission may fail to replay, while
+	// newer submissions are accepted by the broker, before it is dropped (default: 5).
+	// Submissions the broker rejects with a client error are dropped immediately.
+	SpoolMaxAttempts int
+
+	// FlushJitter maximum random delay added to each interval of the flush loop (see Start)
+	FlushJitter time.Duration
+
+	// RetainIdleIntervals number of consecutive flushes a counter or histogram without
+	// activity continues to be submitted (counters as 0, histograms as empty) before
+	// it is expired, default 0 disables retention
+	RetainIdleIntervals uint
+
+	// PersistentCounters counters keep accumulating across flushes rather than
+	// resetting to zero, so they are submitted as monotonic totals
+	PersistentCounters bool
+
+	// Encoder encodes metrics for submission, JSONMetrics and WriteJSONMetrics
+	// (default: JSONEncoder, httptrap JSON format)
+	Encoder Encoder
+
+	// HistogramSummary histograms are summarized into gauges at flush (count, mean
+	// and quantiles), see HistogramSummaryConfig and SummarizeHistogram to configure
+	// individual histograms (default: nil, histograms are not summarized)
+	HistogramSummary *HistogramSummaryConfig
+
+	// SpoolCompress spooled submissions are stored gzip compressed
+	SpoolCompress bool
+
+	// RestoreOnFailure metrics are only discarded after a successful submission, if
+	// sending fails they are merged back into the container for the next flush
+	// (ignored when SpoolDir is set, failed submissions are spooled instead)
+	RestoreOnFailure bool
 }
 
 type TrapMetrics struct {
 	trap                Trap
 	Log                 Logger
+	encoder             Encoder
+	histogramSummary    *HistogramSummaryConfig
+	lastErr             error
 	checkTags           map[string]string
-	metrics             Metrics
+	metrics             *metricStore
+	lastResult          *Result
+	spool               *spool
+	counterHandles      map[uint64]*CounterHandle
+	gaugeHandles        map[uint64]*GaugeHandle
+	histogramSummaries  map[uint64]*HistogramSummaryConfig
+	promHistograms      map[string]*promHistogramState
+	merged              Metrics
+	flushCancel         context.CancelFunc
+	flushDone           chan struct{}
 	trapID              string
 	globalTags          Tags
 	bufferSize          uint
-	metricsmu           sync.Mutex
+	maxPayloadBytes     int
+	maxPayloadMetrics   int
+	retainIdleIntervals uint
+	flushJitter         time.Duration
+	flushmu             sync.Mutex
+	handlesmu           sync.Mutex
+	summarymu           sync.RWMutex
+	promHistogramsmu    sync.Mutex
+	mergedmu            sync.Mutex
 	nonPrintCharReplace rune
+	persistentCounters  bool
+	restoreOnFailure    bool
 }
 
 func New(cfg *Config) (*TrapMetrics, error) {
@@ -70,10 +144,22 @@ func New(cfg *Config) (*TrapMetrics, error) {
 
 	tm := &TrapMetrics{
 		trap:                cfg.Trap,
-		metrics:             make(Metrics),
+		metrics:             newMetricStore(),
+		counterHandles:      make(map[uint64]*CounterHandle),
+		gaugeHandles:        make(map[uint64]*GaugeHandle),
+		histogramSummaries:  make(map[uint64]*HistogramSummaryConfig),
+		promHistograms:      make(map[string]*promHistogramState),
+		merged:              make(Metrics),
+		histogramSummary:    cfg.HistogramSummary,
 		globalTags:          cfg.GlobalTags,
 		nonPrintCharReplace: rune('_'),
 		checkTags:           make(map[string]string),
+		flushJitter:         cfg.FlushJitter,
+		persistentCounters:  cfg.PersistentCounters,
+		retainIdleIntervals: cfg.RetainIdleIntervals,
+		restoreOnFailure:    cfg.RestoreOnFailure,
+		maxPayloadBytes:     cfg.MaxPayloadBytes,
+		maxPayloadMetrics:   cfg.MaxPayloadMetrics,
 	}
 
 	if cfg.Logger != nil {
@@ -93,12 +179,29 @@ func New(cfg *Config) (*TrapMetrics, error) {
 		tm.nonPrintCharReplace = rune(cfg.NonPrintCharReplace[0])
 	}
 
+	if err := validateSummaryConfig(cfg.HistogramSummary); err != nil {
+		return nil, err
+	}
+
+	if cfg.SpoolDir != "" {
+		s, err := newSpool(cfg.SpoolDir, cfg.SpoolMaxBytes, cfg.SpoolMaxAge, cfg.SpoolMaxAttempts, cfg.SpoolCompress)
+		if err != nil {
+			return nil, err
+		}
+		tm.spool = s
+	}
+
+	tm.encoder = cfg.Encoder
+	if tm.encoder == nil {
+		tm.encoder = JSONEncoder{}
+	}
+
 	return tm, nil
 }
 
 // JSONMetrics returns the current metrics in JSON format or an error - to be used
-// when handling submission of metrics externally (e.g. aggregating multiple sets
-// of metrics from different trapmetrics containers).
+// when handling submission of metrics externally. To aggregate metrics from
+// multiple trapmetrics containers into one submission use Merge.
 func (tm *TrapMetrics) JSONMetrics() ([]byte, error) {
 	buf, err := tm.jsonMetrics()
 	if err != nil {
@@ -108,8 +211,9 @@ func (tm *TrapMetrics) JSONMetrics() ([]byte, error) {
 }
 
 // WriteJSONMetrics writes current metrics to provided buffers in JSON format or an error - to be used
-// when handling submission of metrics externally (e.g. aggregating multiple sets
-// of metrics from different trapmetrics containers).
+// when handling submission of metrics externally. To aggregate metrics from
+// multiple trapmetrics containers into one submission use Merge. To write metrics
+// in another format use WriteMetrics.
 func (tm *TrapMetrics) WriteJSONMetrics(w io.Writer) error {
 	return tm.writeJSONMetrics(w)
 }
@@ -130,6 +234,8 @@ type Result struct {
 	FlushDuration   time.Duration
 	BytesSent       int
 	BytesSentGzip   int
+	Replayed        int // number of spooled submissions replayed
+	Submissions     int // number of payloads sent (see Config.MaxPayloadBytes and Config.MaxPayloadMetrics)
 }
 
 // Flush sends metrics to the configured trap check, returns result or an error.
@@ -143,13 +249,16 @@ func (tm *TrapMetrics) Flush(ctx context.Context) (*Result, error) {
 	return tm.FlushWithBuffer(ctx, buf)
 }
 
-// FlushRawJSON sends JSON (in httptrap format) data to the broker.
+// FlushRawJSON sends JSON (in httptrap format) data to the broker, followed
+// by any metrics in the container (see FlushWithBuffer).
 func (tm *TrapMetrics) FlushRawJSON(ctx context.Context, data []byte) (*Result, error) {
 	buf := bytes.NewBuffer(data)
 	return tm.FlushWithBuffer(ctx, *buf)
 }
 
 // FlushWithBuffer sends metrics to the configured trap check, returns result or an error.
+// A non-empty buf (JSON in httptrap format) is sent as a separate submission,
+// ahead of the metrics in the container.
 func (tm *TrapMetrics) FlushWithBuffer(ctx context.Context, buf bytes.Buffer) (*Result, error) {
 	if tm.trap == nil {
 		return nil, fmt.Errorf("no trap check configured")
@@ -157,38 +266,104 @@ func (tm *TrapMetrics) FlushWithBuffer(ctx context.Context, buf bytes.Buffer) (*
 
 	start := time.Now()
 
-	if err := tm.writeJSONMetrics(&buf); err != nil {
+	replayed, replayErr := tm.replaySpool(ctx)
+	if replayErr != nil {
+		tm.Log.Warnf("replaying spool: %s", replayErr)
+	}
+
+	snapshot := tm.snapshotMetrics()
+	chunks, err := tm.encodeMetricChunks(bytes.Buffer{}, snapshot)
+	if err != nil {
+		tm.restoreSnapshot(snapshot)
 		return nil, fmt.Errorf("packaging metrics for submission: %w", err)
 	}
 
-	if buf.Len() == 0 {
-		return &Result{Error: "no metrics to send"}, nil
+	// data provided by the caller is a complete payload, sent on its own
+	if buf.Len() > 0 {
+		chunks = append([]*metricChunk{{buf: buf}}, chunks...)
 	}
 
+	if len(chunks) == 0 {
+		return &Result{Error: "no metrics to send", Replayed: replayed}, nil
+	}
+
+	return tm.submit(ctx, start, chunks, replayed, replayErr)
+}
+
+// submit sends each chunk to the trap check, aggregating the results.
+func (tm *TrapMetrics) submit(ctx context.Context, start time.Time, chunks []*metricChunk, replayed int, replayErr error) (*Result, error) {
 	result := &Result{
 		EncodeDuration: time.Since(start),
+		Replayed:       replayed,
+	}
+
+	for i, chunk := range chunks {
+		smResult, err := tm.trap.SendMetrics(ctx, chunk.buf)
+		if err != nil {
+			return nil, tm.failSubmission(chunks[i:], err)
+		}
+		result.Submissions++
+		if smResult == nil {
+			continue
+		}
+
+		result.CheckUUID = smResult.CheckUUID
+		result.SubmitUUID = smResult.SubmitUUID
+		if smResult.Error != "" {
+			if result.Error != "" {
+				result.Error += "; "
+			}
+			result.Error += smResult.Error
+		}
+		result.Stats += smResult.Stats
+		result.Filtered += smResult.Filtered
+		result.SubmitDuration += smResult.SubmitDuration
+		result.LastReqDuration = smResult.LastReqDuration
+		result.BytesSentGzip += smResult.BytesSentGzip
+		result.BytesSent += smResult.BytesSent
+	}
+
+	if replayErr != nil {
+		// the broker is accepting submissions, the spooled payload is the problem
+		tm.spoolReplayFailed()
 	}
 
-	smResult, err := tm.trap.SendMetrics(ctx, buf)
-	if err != nil {
-		return nil, fmt.Errorf("submitting metrics to broker: %w", err)
-	}
-
-	result.CheckUUID = smResult.CheckUUID
-	result.Error = smResult.Error
-	result.SubmitUUID = smResult.SubmitUUID
-	result.Stats = smResult.Stats
-	result.Filtered = smResult.Filtered
-	result.SubmitDuration = smResult.SubmitDuration
-	result.LastReqDuration = smResult.LastReqDuration
-	result.BytesSentGzip = smResult.BytesSentGzip
-	result.BytesSent = smResult.BytesSent
 	result.FlushDuration = time.Since(start)
 
-	tm.Log.Debugf("flush -- C:%s, S:%s, E:%s, Stats:%d, Filtered:%d, Bytes:%d, Encode:%s, Submit:%s, LastReq:%s, Flush:%s",
+	tm.Log.Debugf("flush -- C:%s, S:%s, E:%s, Stats:%d, Filtered:%d, Bytes:%d, Submissions:%d, Encode:%s, Submit:%s, LastReq:%s, Flush:%s",
 		result.CheckUUID, result.SubmitUUID, result.Error,
-		result.Stats, result.Filtered, result.BytesSentGzip,
+		result.Stats, result.Filtered, result.BytesSentGzip, result.Submissions,
 		result.EncodeDuration, result.SubmitDuration, result.LastReqDuration, result.FlushDuration)
 
 	return result, nil
 }
+
+// failSubmission handles chunks which could not be sent - they are spooled or
+// restored into the container (if configured), returns the error to report.
+func (tm *TrapMetrics) failSubmission(chunks []*metricChunk, sendErr error) error {
+	if tm.spool == nil {
+		if tm.restoreOnFailure {
+			for _, chunk := range chunks {
+				tm.restoreMetrics(chunk.metrics)
+			}
+		}
+		return fmt.Errorf("submitting metrics to broker: %w", sendErr)
+	}
+
+	for _, chunk := range chunks {
+		if err := tm.spool.store(chunk.buf.Bytes()); err != nil {
+			tm.Log.Errorf("spooling metrics: %s", err)
+			return fmt.Errorf("submitting metrics to broker: %w", sendErr)
+		}
+	}
+
+	return fmt.Errorf("submitting metrics to broker (spooled): %w", sendErr)
+}
+
+// restoreSnapshot puts unsent metrics back into the container, if configured.
+func (tm *TrapMetrics) restoreSnapshot(snapshot Metrics) {
+	if !tm.restoreOnFailure {
+		return
+	}
+	tm.restoreMetrics(snapshot)
+}
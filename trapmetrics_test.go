@@ -8,11 +8,16 @@ package trapmetrics
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/circonus-labs/go-apiclient"
 	"github.com/circonus-labs/go-trapcheck"
+	"github.com/openhistogram/circonusllhist"
 )
 
 type FakeTrap struct {
@@ -26,6 +31,36 @@ func (ft FakeTrap) UpdateCheckTags(_ context.Context, _ []string) (*apiclient.Ch
 	return nil, nil
 }
 
+// RecordingTrap keeps a copy of every submission and returns a result (or err) for each.
+type RecordingTrap struct {
+	err      error
+	payloads [][]byte
+	mu       sync.Mutex
+}
+
+func (rt *RecordingTrap) SendMetrics(_ context.Context, metrics bytes.Buffer) (*trapcheck.TrapResult, error) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.err != nil {
+		return nil, rt.err
+	}
+	rt.payloads = append(rt.payloads, append([]byte(nil), metrics.Bytes()...))
+	return &trapcheck.TrapResult{Stats: 1, BytesSent: metrics.Len()}, nil
+}
+func (rt *RecordingTrap) UpdateCheckTags(_ context.Context, _ []string) (*apiclient.CheckBundle, error) {
+	return nil, nil
+}
+func (rt *RecordingTrap) setErr(err error) {
+	rt.mu.Lock()
+	rt.err = err
+	rt.mu.Unlock()
+}
+func (rt *RecordingTrap) Payloads() [][]byte {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return append([][]byte(nil), rt.payloads...)
+}
+
 func TestNew(t *testing.T) {
 	tests := []struct {
 		cfg     *Config
@@ -56,3 +91,195 @@ func TestNew(t *testing.T) {
 		})
 	}
 }
+
+func TestTrapMetrics_FlushRestoreOnFailure(t *testing.T) {
+	trap := &RecordingTrap{}
+	tm, err := New(&Config{Trap: trap, RestoreOnFailure: true})
+	if err != nil {
+		t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+	}
+
+	ctx := context.Background()
+	ts := time.Now()
+
+	if err := tm.CounterIncrementByValue("counter", nil, 2); err != nil {
+		t.Fatalf("TrapMetrics.CounterIncrementByValue() error = %v", err)
+	}
+	if err := tm.HistogramRecordValue("histogram", nil, 1); err != nil {
+		t.Fatalf("TrapMetrics.HistogramRecordValue() error = %v", err)
+	}
+	if err := tm.GaugeSet("gauge", nil, 1, &ts); err != nil {
+		t.Fatalf("TrapMetrics.GaugeSet() error = %v", err)
+	}
+
+	trap.setErr(errors.New("broker unavailable"))
+	if _, err := tm.Flush(ctx); err == nil {
+		t.Fatal("expected flush error")
+	}
+
+	// recorded while the failed submission was in flight
+	ts2 := ts.Add(time.Second)
+	if err := tm.CounterIncrement("counter", nil); err != nil {
+		t.Fatalf("TrapMetrics.CounterIncrement() error = %v", err)
+	}
+	if err := tm.HistogramRecordValue("histogram", nil, 1); err != nil {
+		t.Fatalf("TrapMetrics.HistogramRecordValue() error = %v", err)
+	}
+	if err := tm.GaugeSet("gauge", nil, 2, &ts2); err != nil {
+		t.Fatalf("TrapMetrics.GaugeSet() error = %v", err)
+	}
+
+	c, err := tm.CounterFetch("counter", nil)
+	if err != nil {
+		t.Fatalf("TrapMetrics.CounterFetch() error = %v", err)
+	}
+	if c.Samples[0] != int64(3) {
+		t.Errorf("counter want 3 got %v", c.Samples[0])
+	}
+
+	h, err := tm.HistogramFetch("histogram", nil)
+	if err != nil {
+		t.Fatalf("TrapMetrics.HistogramFetch() error = %v", err)
+	}
+	if hist, ok := h.Samples[0].(*circonusllhist.Histogram); !ok || hist.Count() != 2 {
+		t.Errorf("histogram count want 2 got %v", h.Samples[0])
+	}
+
+	g, err := tm.GaugeFetch("gauge", nil)
+	if err != nil {
+		t.Fatalf("TrapMetrics.GaugeFetch() error = %v", err)
+	}
+	if len(g.Samples) != 2 {
+		t.Errorf("gauge samples want 2 got %d", len(g.Samples))
+	}
+
+	trap.setErr(nil)
+	if _, err := tm.Flush(ctx); err != nil {
+		t.Fatalf("TrapMetrics.Flush() error = %v", err)
+	}
+	if _, err := tm.CounterFetch("counter", nil); err == nil {
+		t.Error("expected metrics to be discarded after successful submission")
+	}
+}
+
+func TestTrapMetrics_FlushMaxPayload(t *testing.T) {
+	tests := []struct {
+		cfg             *Config
+		name            string
+		wantSubmissions int
+	}{
+		{
+			name:            "no limit",
+			cfg:             &Config{},
+			wantSubmissions: 1,
+		},
+		{
+			name:            "max metrics",
+			cfg:             &Config{MaxPayloadMetrics: 3},
+			wantSubmissions: 4,
+		},
+		{
+			name:            "max bytes",
+			cfg:             &Config{MaxPayloadBytes: 256},
+			wantSubmissions: 4,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+
+		t.Run(tt.name, func(t *testing.T) {
+			trap := &RecordingTrap{}
+			tt.cfg.Trap = trap
+			tm, err := New(tt.cfg)
+			if err != nil {
+				t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+			}
+
+			for i := 0; i < 10; i++ {
+				if err := tm.CounterIncrement(fmt.Sprintf("counter%02d", i), Tags{{Category: "foo", Value: "bar"}}); err != nil {
+					t.Fatalf("TrapMetrics.CounterIncrement() error = %v", err)
+				}
+			}
+
+			result, err := tm.Flush(context.Background())
+			if err != nil {
+				t.Fatalf("TrapMetrics.Flush() error = %v", err)
+			}
+			if result.Submissions != tt.wantSubmissions {
+				t.Errorf("submissions want %d got %d", tt.wantSubmissions, result.Submissions)
+			}
+			if result.Stats != uint64(tt.wantSubmissions) {
+				t.Errorf("aggregated stats want %d got %d", tt.wantSubmissions, result.Stats)
+			}
+
+			seen := 0
+			for _, p := range trap.Payloads() {
+				var metrics map[string]interface{}
+				if err := json.Unmarshal(p, &metrics); err != nil {
+					t.Fatalf("invalid payload %s: %s", p, err)
+				}
+				if tt.cfg.MaxPayloadBytes > 0 && len(p) > tt.cfg.MaxPayloadBytes {
+					t.Errorf("payload exceeds max bytes (%d) %s", len(p), p)
+				}
+				if tt.cfg.MaxPayloadMetrics > 0 && len(metrics) > tt.cfg.MaxPayloadMetrics {
+					t.Errorf("payload exceeds max metrics (%d) %s", len(metrics), p)
+				}
+				seen += len(metrics)
+			}
+			if seen != 10 {
+				t.Errorf("metrics submitted want 10 got %d", seen)
+			}
+		})
+	}
+}
+
+func TestTrapMetrics_FlushRawJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		metrics []string
+		want    int
+	}{
+		{name: "empty container", want: 1},
+		{name: "metrics in container", metrics: []string{"a", "b"}, want: 2},
+	}
+
+	data := `{"raw":{"_type":"L","_value":1}}`
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			trap := &RecordingTrap{}
+			tm, err := New(&Config{Trap: trap})
+			if err != nil {
+				t.Fatalf("unable to initialize TrapMetrics for test: %s", err)
+			}
+			for _, name := range tt.metrics {
+				if err := tm.CounterIncrement(name, nil); err != nil {
+					t.Fatalf("TrapMetrics.CounterIncrement() error = %v", err)
+				}
+			}
+
+			result, err := tm.FlushRawJSON(context.Background(), []byte(data))
+			if err != nil {
+				t.Fatalf("TrapMetrics.FlushRawJSON() error = %v", err)
+			}
+			if result.Submissions != tt.want {
+				t.Errorf("submissions want %d got %d", tt.want, result.Submissions)
+			}
+
+			payloads := trap.Payloads()
+			if len(payloads) != tt.want || string(payloads[0]) != data {
+				t.Fatalf("payloads want [%s] first, %d total, got %q", data, tt.want, payloads)
+			}
+			for _, p := range payloads[1:] {
+				metrics, err := DecodeJSONMetrics(p)
+				if err != nil {
+					t.Fatalf("DecodeJSONMetrics() error = %v", err)
+				}
+				if len(metrics) != len(tt.metrics) {
+					t.Errorf("metrics want %d got %d", len(tt.metrics), len(metrics))
+				}
+			}
+		})
+	}
+}